@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sessionCookie = "lts_session"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// managementAuth protects the dashboard and management API. API clients
+// authenticate with a bearer token; the dashboard gets a session cookie and a
+// CSRF token derived from it.
+type managementAuth struct {
+	token        string
+	allowedHosts []string
+}
+
+// newManagementAuth loads the bearer token, creating it on first run, and
+// builds the Host allowlist
+func newManagementAuth(cfg WebConfig, bind string) (*managementAuth, error) {
+	token, err := loadOrCreateToken(cfg.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := append([]string(nil), cfg.AllowedHosts...)
+	if isUnspecifiedHost(bind) {
+		// Listening on every interface, so the machine may be reached by
+		// any of its addresses or by its name
+		hosts = append(hosts, localHosts()...)
+	} else if bind != "" {
+		hosts = append(hosts, bind)
+	}
+
+	return &managementAuth{token: token, allowedHosts: hosts}, nil
+}
+
+// loadOrCreateToken reads the token file, generating a new token readable
+// only by the owner when it does not exist
+func loadOrCreateToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create token directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to save token: %w", err)
+	}
+
+	slog.Info("Generated management API token", "file", path)
+	return token, nil
+}
+
+// randomToken returns 32 random bytes encoded as hex
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// csrfToken derives the CSRF token belonging to a dashboard session
+func (a *managementAuth) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, []byte(a.token))
+	mac.Write([]byte(session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hostAllowed reports whether the Host header of r is on the allowlist
+func (a *managementAuth) hostAllowed(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+
+	for _, allowed := range a.allowedHosts {
+		if strings.EqualFold(host, strings.Trim(allowed, "[]")) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBearerToken reports whether r carries the management token
+func (a *managementAuth) hasBearerToken(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+}
+
+// session returns the session cookie of r, or "" when there is none
+func (a *managementAuth) session(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// hasValidCSRF reports whether r carries the CSRF token of its session
+func (a *managementAuth) hasValidCSRF(r *http.Request) bool {
+	session := a.session(r)
+	if session == "" || !a.validSessionCookie(session) {
+		return false
+	}
+	given := r.Header.Get(csrfHeader)
+	return subtle.ConstantTimeCompare([]byte(given), []byte(a.csrfToken(session))) == 1
+}
+
+// RequireHost rejects requests whose Host header is not allowed
+func (a *managementAuth) RequireHost(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.hostAllowed(r) {
+			slog.Warn("Rejected request for unknown host; list it in web.allowed_hosts", "host", r.Host, "remote", r.RemoteAddr)
+			http.Error(w, "Host not allowed", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireAuth protects a management route. Requests need either the bearer
+// token or a dashboard session with its CSRF token.
+func (a *managementAuth) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return a.RequireHost(func(w http.ResponseWriter, r *http.Request) {
+		if !a.hasBearerToken(r) && !a.hasValidCSRF(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// DashboardSession returns the CSRF token for the dashboard, starting a
+// session when needed. Clients outside the loopback interface must present
+// the bearer token once as ?token=... to be given a session.
+func (a *managementAuth) DashboardSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if session := a.session(r); session != "" && a.validSessionCookie(session) {
+		return a.csrfToken(session), true
+	}
+
+	given := r.URL.Query().Get("token")
+	tokenOK := subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+	if !isLoopbackRequest(r) && !tokenOK {
+		return "", false
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		return "", false
+	}
+	session := nonce + "." + a.csrfToken("session:"+nonce)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return a.csrfToken(session), true
+}
+
+// validSessionCookie reports whether session was issued by this server
+func (a *managementAuth) validSessionCookie(session string) bool {
+	nonce, mac, ok := strings.Cut(session, ".")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(mac), []byte(a.csrfToken("session:"+nonce))) == 1
+}
+
+// isLoopbackRequest reports whether r comes from the local machine
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isUnspecifiedHost reports whether host listens on every interface
+func isUnspecifiedHost(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsUnspecified()
+}
+
+// localHosts returns the name of this machine and the addresses of its
+// interfaces
+func localHosts() []string {
+	var hosts []string
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+		if short, _, ok := strings.Cut(name, "."); ok {
+			hosts = append(hosts, short)
+		} else {
+			hosts = append(hosts, name+".local")
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		slog.Warn("Could not list the addresses of this machine", "error", err)
+		return hosts
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// isLoopbackHost reports whether host only listens on the loopback interface
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// StartOptions holds the settings a backend uses to run LibreTranslate
+type StartOptions struct {
+	Host        string
+	Port        int
+	Verbose     bool
+	StopTimeout time.Duration
+	Resources   ResourceConfig
+	// LoadOnly restricts the languages loaded by the server; empty loads all
+	LoadOnly []string
+}
+
+// Backend is a runtime able to host a LibreTranslate instance
+type Backend interface {
+	// Name returns the backend type as used in the configuration file
+	Name() string
+	// URL returns the base URL the instance is reachable on
+	URL() string
+	// Check verifies the backend's prerequisites are available
+	Check() error
+	// Install prepares the backend so that Start can succeed
+	Install() error
+	// Start launches the instance without waiting for it to become ready
+	Start() error
+	// Wait blocks until the instance started by Start exits
+	Wait() error
+	// Stop shuts the instance down
+	Stop() error
+	// Health returns nil when the instance answers API requests
+	Health() error
+	// Logs returns up to n of the most recent log lines
+	Logs(n int) ([]string, error)
+}
+
+// suspender is implemented by backends able to pause a running server
+// without unloading it
+type suspender interface {
+	Suspend() error
+	Resume() error
+}
+
+// newBackend creates the backend selected in the configuration
+func newBackend(cfg BackendConfig, opts StartOptions) (Backend, error) {
+	opts.StopTimeout = time.Duration(cfg.StopTimeout)
+	opts.Resources = cfg.Resources
+	switch cfg.Type {
+	case "", "native":
+		return newNativeBackend(opts), nil
+	case "container":
+		return newContainerBackend(cfg.Container, opts), nil
+	case "external":
+		return newExternalBackend(cfg.External)
+	case "fake":
+		return newFakeBackend(cfg.Fake, opts)
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", cfg.Type)
+	}
+}
+
+// localURL returns the base URL of an instance listening on the loopback
+// interface
+func localURL(port int) string {
+	return fmt.Sprintf("http://127.0.0.1:%d", port)
+}
+
+// healthClient gives up on a server that accepts connections but does not
+// answer, such as one that is suspended
+var healthClient = &http.Client{Timeout: 5 * time.Second}
+
+// checkHealth returns nil when the LibreTranslate instance at baseURL answers
+func checkHealth(baseURL string) error {
+	resp, err := healthClient.Get(baseURL + "/languages")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// startProcess starts cmd, relaying its output to the log and to logs
+func startProcess(cmd *exec.Cmd, logs *logBuffer) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	go streamOutput(stdout, "stdout", logs)
+	go streamOutput(stderr, "stderr", logs)
+
+	return nil
+}
+
+// logBuffer keeps the most recent lines of output in memory
+type logBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	size  int
+}
+
+// newLogBuffer creates a buffer holding at most size lines
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{size: size}
+}
+
+// Add appends a line, discarding the oldest one when full
+func (b *logBuffer) Add(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.size {
+		b.lines = b.lines[len(b.lines)-b.size:]
+	}
+}
+
+// Tail returns up to n of the most recent lines
+func (b *logBuffer) Tail(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n <= 0 || n > len(b.lines) {
+		n = len(b.lines)
+	}
+	return append([]string(nil), b.lines[len(b.lines)-n:]...)
+}
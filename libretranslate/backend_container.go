@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// containerModelsPath is where the LibreTranslate image keeps its models
+const containerModelsPath = "/home/libretranslate/.local"
+
+// containerBackend runs the LibreTranslate image through a docker-compatible CLI
+type containerBackend struct {
+	cfg  ContainerConfig
+	opts StartOptions
+	cmd  *exec.Cmd
+	logs *logBuffer
+}
+
+// newContainerBackend creates a backend running LibreTranslate in a container
+func newContainerBackend(cfg ContainerConfig, opts StartOptions) *containerBackend {
+	return &containerBackend{cfg: cfg, opts: opts, logs: newLogBuffer(500)}
+}
+
+func (b *containerBackend) Name() string { return "container" }
+
+func (b *containerBackend) URL() string { return localURL(b.opts.Port) }
+
+// name returns the name of the container, which holds the port so that
+// servers on different ports do not collide
+func (b *containerBackend) name() string {
+	return fmt.Sprintf("%s-%d", b.cfg.Name, b.opts.Port)
+}
+
+// runtime returns the configured container CLI, or the first of docker and
+// podman found in PATH
+func (b *containerBackend) runtime() (string, error) {
+	if b.cfg.Runtime != "" {
+		return exec.LookPath(b.cfg.Runtime)
+	}
+
+	for _, name := range []string{"docker", "podman"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no container runtime found (install docker or podman)")
+}
+
+func (b *containerBackend) Check() error {
+	slog.Info("Checking dependencies")
+
+	rt, err := b.runtime()
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command(rt, "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("container runtime not working: %w", err)
+	}
+	slog.Info("Found container runtime", "version", strings.TrimSpace(string(output)))
+	return nil
+}
+
+func (b *containerBackend) Install() error {
+	rt, err := b.runtime()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Pulling image", "image", b.cfg.Image)
+	cmd := exec.Command(rt, "pull", b.cfg.Image)
+	cmd.Stdout = color.Output
+	cmd.Stderr = color.Error
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to pull image: %w", err)
+	}
+	return nil
+}
+
+func (b *containerBackend) Start() error {
+	rt, err := b.runtime()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.cfg.ModelsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create models directory: %w", err)
+	}
+
+	args := []string{
+		"run", "--rm",
+		"--name", b.name(),
+		"-p", fmt.Sprintf("%s:%d:5000", b.opts.Host, b.opts.Port),
+		"-v", b.cfg.ModelsDir + ":" + containerModelsPath,
+	}
+	args = append(args, containerResourceArgs(b.opts.Resources)...)
+	args = append(args, b.cfg.ExtraArgs...)
+	args = append(args, b.cfg.Image)
+
+	if len(b.opts.LoadOnly) > 0 {
+		args = append(args, "--load-only", strings.Join(b.opts.LoadOnly, ","))
+	}
+	if b.opts.Verbose {
+		args = append(args, "--debug")
+	}
+
+	b.cmd = exec.Command(rt, args...)
+	// Keep Ctrl+C away from the client; Stop shuts the container down
+	setProcessGroup(b.cmd)
+	return startProcess(b.cmd, b.logs)
+}
+
+// containerResourceArgs translates the resource limits into run options;
+// the runtime enforces them, so they work on every platform
+func containerResourceArgs(cfg ResourceConfig) []string {
+	var args []string
+	if cfg.MemoryMB > 0 {
+		args = append(args, "--memory", strconv.Itoa(cfg.MemoryMB)+"m")
+	}
+	if cfg.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(cfg.CPUs, 'f', -1, 64))
+	}
+	if cfg.Threads > 0 {
+		args = append(args, "-e", "LT_THREADS="+strconv.Itoa(cfg.Threads))
+		for _, name := range threadEnvVars {
+			args = append(args, "-e", name+"="+strconv.Itoa(cfg.Threads))
+		}
+	}
+	return args
+}
+
+func (b *containerBackend) Wait() error {
+	if b.cmd == nil {
+		return fmt.Errorf("container was not started by this process")
+	}
+	return b.cmd.Wait()
+}
+
+func (b *containerBackend) Stop() error {
+	rt, err := b.runtime()
+	if err != nil {
+		return err
+	}
+
+	timeout := strconv.Itoa(int(b.opts.StopTimeout.Seconds()))
+	output, err := exec.Command(rt, "stop", "-t", timeout, b.name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to stop container: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Suspend pauses the container, keeping its models in memory
+func (b *containerBackend) Suspend() error { return b.control("pause") }
+
+// Resume continues a container paused by Suspend
+func (b *containerBackend) Resume() error { return b.control("unpause") }
+
+// control runs a runtime command such as pause on the container
+func (b *containerBackend) control(command string) error {
+	rt, err := b.runtime()
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command(rt, command, b.name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to %s container: %s", command, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (b *containerBackend) Health() error { return checkHealth(b.URL()) }
+
+// Logs returns the lines kept from the attached container, or asks the
+// runtime when the container was started by another process
+func (b *containerBackend) Logs(n int) ([]string, error) {
+	if b.cmd != nil {
+		return b.logs.Tail(n), nil
+	}
+
+	rt, err := b.runtime()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := exec.Command(rt, "logs", "--tail", strconv.Itoa(n), b.name()).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container logs: %s", strings.TrimSpace(string(output)))
+	}
+	return strings.Split(strings.TrimRight(string(output), "\n"), "\n"), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// externalBackend attaches to a LibreTranslate instance that this tool does
+// not spawn. It is still monitored and proxied like a local one.
+type externalBackend struct {
+	url  string
+	done chan struct{}
+}
+
+// newExternalBackend creates a backend for the instance at cfg.URL
+func newExternalBackend(cfg ExternalConfig) (*externalBackend, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("external backend needs a valid url, got %q", cfg.URL)
+	}
+	return &externalBackend{url: strings.TrimRight(cfg.URL, "/")}, nil
+}
+
+func (b *externalBackend) Name() string { return "external" }
+
+func (b *externalBackend) URL() string { return b.url }
+
+func (b *externalBackend) Check() error { return nil }
+
+func (b *externalBackend) Install() error {
+	color.Yellow("ℹ  External backend at %s needs no installation\n", b.url)
+	return nil
+}
+
+// Start only begins monitoring; the instance is expected to be run elsewhere
+func (b *externalBackend) Start() error {
+	b.done = make(chan struct{})
+	return nil
+}
+
+// Wait reports health changes of the external instance until Stop is called
+func (b *externalBackend) Wait() error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-b.done:
+			return nil
+		case <-ticker.C:
+			err := b.Health()
+			if err != nil && healthy {
+				slog.Error("External server is not responding", "url", b.url, "error", err)
+			} else if err == nil && !healthy {
+				slog.Info("External server is responding again", "url", b.url)
+			}
+			healthy = err == nil
+		}
+	}
+}
+
+func (b *externalBackend) Stop() error {
+	if b.done == nil {
+		return fmt.Errorf("external server %s is not managed by this tool", b.url)
+	}
+	close(b.done)
+	return nil
+}
+
+func (b *externalBackend) Health() error { return checkHealth(b.url) }
+
+func (b *externalBackend) Logs(n int) ([]string, error) {
+	return nil, fmt.Errorf("logs are not available for external servers")
+}
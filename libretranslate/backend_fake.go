@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Translation modes of the fake backend
+const (
+	fakePrefix  = "prefix"
+	fakeReverse = "reverse"
+	fakeTable   = "table"
+)
+
+// fakeBackend serves a LibreTranslate-compatible API from this process, so
+// the server lifecycle, the proxy and the extension can be exercised without
+// Python or models. Its translations are deterministic.
+type fakeBackend struct {
+	cfg       FakeConfig
+	opts      StartOptions
+	languages []string
+	// table maps target codes to the translations of texts
+	table  map[string]map[string]string
+	server *http.Server
+	done   chan error
+	logs   *logBuffer
+}
+
+// newFakeBackend creates an in-process fake LibreTranslate backend
+func newFakeBackend(cfg FakeConfig, opts StartOptions) (*fakeBackend, error) {
+	b := &fakeBackend{cfg: cfg, opts: opts, logs: newLogBuffer(500)}
+	if b.cfg.Mode == "" {
+		b.cfg.Mode = fakePrefix
+	}
+	if b.cfg.ErrorStatus == 0 {
+		b.cfg.ErrorStatus = http.StatusServiceUnavailable
+	}
+	if b.cfg.ErrorRate < 0 || b.cfg.ErrorRate > 1 {
+		return nil, fmt.Errorf("fake error rate must be between 0 and 1, not %g", b.cfg.ErrorRate)
+	}
+
+	switch b.cfg.Mode {
+	case fakePrefix, fakeReverse:
+	case fakeTable:
+		if b.cfg.Table == "" {
+			return nil, fmt.Errorf("the table mode of the fake backend needs a table file")
+		}
+		data, err := os.ReadFile(b.cfg.Table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fake translation table: %w", err)
+		}
+		if err := json.Unmarshal(data, &b.table); err != nil {
+			return nil, fmt.Errorf("invalid fake translation table %s: %w", b.cfg.Table, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown fake mode %q (expected prefix, reverse or table)", b.cfg.Mode)
+	}
+
+	b.languages = []string{"en", "es", "fr", "de"}
+	if len(b.cfg.Languages) > 0 {
+		b.languages = b.cfg.Languages
+	}
+	if len(opts.LoadOnly) > 0 {
+		b.languages = opts.LoadOnly
+	}
+	return b, nil
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) URL() string { return localURL(b.opts.Port) }
+
+func (b *fakeBackend) Check() error { return nil }
+
+func (b *fakeBackend) Install() error { return nil }
+
+func (b *fakeBackend) Start() error {
+	if b.opts.Verbose {
+		// The server runs in this process, so its debug output is ours
+		logLevel.Set(slog.LevelDebug)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", b.opts.Host, b.opts.Port))
+	if err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/languages", b.handleLanguages)
+	mux.HandleFunc("/translate", b.handleTranslate)
+	mux.HandleFunc("/detect", b.handleDetect)
+	mux.HandleFunc("/frontend/settings", b.handleSettings)
+
+	b.server = &http.Server{Handler: b.logRequests(mux)}
+	b.done = make(chan error, 1)
+	go func() {
+		b.done <- b.server.Serve(listener)
+	}()
+
+	b.logs.Add(fmt.Sprintf("fake server listening on %s (mode %s)", listener.Addr(), b.cfg.Mode))
+	return nil
+}
+
+func (b *fakeBackend) Wait() error {
+	if b.done == nil {
+		return fmt.Errorf("fake server was not started by this process")
+	}
+	if err := <-b.done; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (b *fakeBackend) Stop() error {
+	if b.server == nil {
+		return fmt.Errorf("fake server was not started by this process")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.opts.StopTimeout)
+	defer cancel()
+	return b.server.Shutdown(ctx)
+}
+
+func (b *fakeBackend) Health() error { return checkHealth(b.URL()) }
+
+func (b *fakeBackend) Logs(n int) ([]string, error) { return b.logs.Tail(n), nil }
+
+// logRequests records each request in the logs, and at debug level
+func (b *fakeBackend) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.logs.Add(fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+		slog.Debug("Fake server request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (b *fakeBackend) handleLanguages(w http.ResponseWriter, r *http.Request) {
+	languages := []languageInfo{}
+	for _, code := range b.languages {
+		languages = append(languages, languageInfo{Code: code, Name: languageName(code), Targets: b.languages})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(languages)
+}
+
+// handleTranslate answers single and batch translations in the configured
+// mode, detecting the language of "auto" sources
+func (b *fakeBackend) handleTranslate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "The method is not allowed for the requested URL.")
+		return
+	}
+	req, err := parseTranslateRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, code := range []string{req.Source, req.Target} {
+		if code != "auto" && !b.offers(code) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s is not supported", code))
+			return
+		}
+	}
+	if !b.delay(w, r) {
+		return
+	}
+
+	var texts []string
+	for _, q := range req.Q {
+		texts = append(texts, b.translate(q, req.Target))
+	}
+	answer := map[string]interface{}{"translatedText": texts}
+	if !req.Batch {
+		answer["translatedText"] = texts[0]
+	}
+	if req.Source == "auto" {
+		detected := []map[string]interface{}{}
+		for _, q := range req.Q {
+			detected = append(detected, b.detect(q))
+		}
+		answer["detectedLanguage"] = detected
+		if !req.Batch {
+			answer["detectedLanguage"] = detected[0]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answer)
+}
+
+func (b *fakeBackend) handleDetect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "The method is not allowed for the requested URL.")
+		return
+	}
+	var req struct {
+		Q string `json:"q"`
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		json.NewDecoder(r.Body).Decode(&req)
+	} else {
+		req.Q = r.FormValue("q")
+	}
+	if req.Q == "" {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request: missing q parameter")
+		return
+	}
+	if !b.delay(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]map[string]interface{}{b.detect(req.Q)})
+}
+
+// handleSettings answers like a LibreTranslate server without limits,
+// API keys or file translation
+func (b *fakeBackend) handleSettings(w http.ResponseWriter, r *http.Request) {
+	target := b.languages[0]
+	if len(b.languages) > 1 {
+		target = b.languages[1]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"charLimit":            -1,
+		"frontendTimeout":      500,
+		"apiKeys":              false,
+		"keyRequired":          false,
+		"suggestions":          false,
+		"filesTranslation":     false,
+		"supportedFilesFormat": []string{},
+		"language": map[string]interface{}{
+			"source": map[string]string{"code": "auto", "name": "Auto Detect"},
+			"target": map[string]string{"code": target, "name": languageName(target)},
+		},
+	})
+}
+
+// delay waits for the configured latency and injects failures, returning
+// false when the request was answered with an error or abandoned
+func (b *fakeBackend) delay(w http.ResponseWriter, r *http.Request) bool {
+	wait := time.Duration(b.cfg.Latency)
+	if b.cfg.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(b.cfg.Jitter) + 1))
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return false
+		}
+	}
+
+	if b.cfg.ErrorRate > 0 && rand.Float64() < b.cfg.ErrorRate {
+		writeJSONError(w, b.cfg.ErrorStatus, "Injected failure of the fake server")
+		return false
+	}
+	return true
+}
+
+// translate returns the translation of text to target in the configured
+// mode
+func (b *fakeBackend) translate(text, target string) string {
+	switch b.cfg.Mode {
+	case fakeReverse:
+		runes := []rune(text)
+		for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+			runes[i], runes[j] = runes[j], runes[i]
+		}
+		return string(runes)
+	case fakeTable:
+		if translated, ok := b.table[target][text]; ok {
+			return translated
+		}
+	}
+	return fmt.Sprintf("[%s] %s", target, text)
+}
+
+// detect names the language of text: the first language under which the
+// table lists it as a translation, the code of a "[xx] " prefix, or else
+// the first language offered
+func (b *fakeBackend) detect(text string) map[string]interface{} {
+	language := b.languages[0]
+	if rest, ok := strings.CutPrefix(text, "["); ok {
+		if code, _, ok := strings.Cut(rest, "] "); ok && b.offers(code) {
+			language = code
+		}
+	}
+	for _, code := range b.languages {
+		for _, translated := range b.table[code] {
+			if translated == text {
+				return map[string]interface{}{"language": code, "confidence": 90.0}
+			}
+		}
+	}
+	return map[string]interface{}{"language": language, "confidence": 90.0}
+}
+
+// offers reports whether code is one of the languages of the server
+func (b *fakeBackend) offers(code string) bool {
+	for _, language := range b.languages {
+		if language == code {
+			return true
+		}
+	}
+	return false
+}
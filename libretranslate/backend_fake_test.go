@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startFake starts a fake server on a free port, stopped when the test ends
+func startFake(t *testing.T, cfg FakeConfig) *fakeBackend {
+	t.Helper()
+	b := newStoppedFake(t, cfg)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Stop() })
+	return b
+}
+
+// newStoppedFake creates a fake server on a free port without starting it
+func newStoppedFake(t *testing.T, cfg FakeConfig) *fakeBackend {
+	t.Helper()
+	port, err := freePort("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newFakeBackend(cfg, StartOptions{Host: "127.0.0.1", Port: port, StopTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// translateText asks the server at baseURL to translate q from English to
+// target, returning the status and the decoded answer
+func translateText(t *testing.T, baseURL string, q interface{}, target string) (int, map[string]interface{}) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"q": q, "source": "en", "target": target})
+	resp, err := http.Post(baseURL+"/translate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var answer map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&answer)
+	return resp.StatusCode, answer
+}
+
+func TestFakeBackendLifecycle(t *testing.T) {
+	b := newStoppedFake(t, FakeConfig{})
+	if err := b.Health(); err == nil {
+		t.Fatal("server is healthy before it was started")
+	}
+	if err := b.Stop(); err == nil {
+		t.Fatal("stopping a server that was never started succeeded")
+	}
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Health(); err != nil {
+		t.Fatalf("server is not healthy after starting: %v", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- b.Wait() }()
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("server exited with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Stop")
+	}
+	if err := b.Health(); err == nil {
+		t.Fatal("server is healthy after it was stopped")
+	}
+}
+
+func TestFakeBackendModes(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "table.json")
+	if err := os.WriteFile(table, []byte(`{"es": {"Hello": "Hola"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cfg  FakeConfig
+		q    interface{}
+		want interface{}
+	}{
+		{FakeConfig{}, "Hello", "[es] Hello"},
+		{FakeConfig{Mode: fakeReverse}, "Hello", "olleH"},
+		{FakeConfig{Mode: fakeTable, Table: table}, "Hello", "Hola"},
+		{FakeConfig{Mode: fakeTable, Table: table}, "World", "[es] World"},
+		{FakeConfig{}, []string{"Hello", "World"}, []interface{}{"[es] Hello", "[es] World"}},
+	}
+	for _, tt := range tests {
+		b := startFake(t, tt.cfg)
+		status, answer := translateText(t, b.URL(), tt.q, "es")
+		got, _ := json.Marshal(answer["translatedText"])
+		want, _ := json.Marshal(tt.want)
+		if status != http.StatusOK || !bytes.Equal(got, want) {
+			t.Errorf("%s mode translated %v to %d %s, want %s", tt.cfg.Mode, tt.q, status, got, want)
+		}
+	}
+
+	status, _ := translateText(t, startFake(t, FakeConfig{}).URL(), "Hello", "ja")
+	if status != http.StatusBadRequest {
+		t.Errorf("unsupported target answered %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// nativeBackend runs LibreTranslate as a local pip-installed executable
+type nativeBackend struct {
+	opts   StartOptions
+	cmd    *exec.Cmd
+	logs   *logBuffer
+	limits *resourceLimits
+}
+
+// newNativeBackend creates a backend running the local libretranslate command
+func newNativeBackend(opts StartOptions) *nativeBackend {
+	return &nativeBackend{opts: opts, logs: newLogBuffer(500)}
+}
+
+func (b *nativeBackend) Name() string { return "native" }
+
+func (b *nativeBackend) URL() string { return localURL(b.opts.Port) }
+
+func (b *nativeBackend) Check() error { return checkDependencies() }
+
+func (b *nativeBackend) Install() error { return installDependencies() }
+
+func (b *nativeBackend) Start() error {
+	args := []string{
+		"--host", b.opts.Host,
+		"--port", strconv.Itoa(b.opts.Port),
+	}
+
+	if b.opts.Resources.Threads > 0 {
+		args = append(args, "--threads", strconv.Itoa(b.opts.Resources.Threads))
+	}
+
+	if len(b.opts.LoadOnly) > 0 {
+		args = append(args, "--load-only", strings.Join(b.opts.LoadOnly, ","))
+	}
+
+	if b.opts.Verbose {
+		args = append(args, "--debug")
+	}
+
+	b.cmd = exec.Command(getLibreTranslateCommand(), args...)
+	// Gunicorn forks workers; a process group lets Stop reach all of them
+	setProcessGroup(b.cmd)
+	limits := prepareResourceLimits(b.cmd, b.opts.Resources)
+	if err := startProcess(b.cmd, b.logs); err != nil {
+		releaseResourceLimits(limits)
+		if limits != nil && limits.Cgroup != "" {
+			return fmt.Errorf("%w (starting into cgroup %s needs Linux 5.7 or later)", err, limits.Cgroup)
+		}
+		return err
+	}
+	b.limits = applyResourceLimits(b.cmd.Process.Pid, limits)
+	return nil
+}
+
+// PID returns the process ID of the server started by this process
+func (b *nativeBackend) PID() int {
+	if b.cmd == nil || b.cmd.Process == nil {
+		return 0
+	}
+	return b.cmd.Process.Pid
+}
+
+// ResourceLimits returns the limits applied to the server started by this
+// process
+func (b *nativeBackend) ResourceLimits() *resourceLimits { return b.limits }
+
+func (b *nativeBackend) Wait() error {
+	defer clearInstanceProcess(b.PID())
+	defer releaseResourceLimits(b.limits)
+	return b.cmd.Wait()
+}
+
+// Stop shuts down the process group of the child started by this process,
+// or of the server recorded in the instance file when it was started
+// elsewhere, after checking that the PID still belongs to that server
+func (b *nativeBackend) Stop() error {
+	if pid := b.PID(); pid != 0 {
+		err := stopProcessGroup(pid, b.opts.StopTimeout)
+		clearInstanceProcess(pid)
+		return err
+	}
+
+	state, err := loadInstanceState()
+	if err != nil {
+		return fmt.Errorf("failed to read instance state: %w", err)
+	}
+	if state.PID == 0 {
+		return fmt.Errorf("no server running (no process recorded in %s)", instanceFile)
+	}
+
+	if err := state.verifyProcess(); err != nil {
+		clearInstanceProcess(state.PID)
+		return fmt.Errorf("not stopping: %w", err)
+	}
+
+	if err := stopProcessGroup(state.PID, b.opts.StopTimeout); err != nil {
+		return err
+	}
+	clearInstanceProcess(state.PID)
+	return nil
+}
+
+// Suspend pauses the process group of the running server
+func (b *nativeBackend) Suspend() error {
+	pid, err := b.runningPID()
+	if err != nil {
+		return err
+	}
+	return suspendProcessGroup(pid)
+}
+
+// Resume continues a server paused by Suspend
+func (b *nativeBackend) Resume() error {
+	pid, err := b.runningPID()
+	if err != nil {
+		return err
+	}
+	return resumeProcessGroup(pid)
+}
+
+// runningPID returns the PID of the server, checking that it still belongs
+// to the server when it was recorded by another process
+func (b *nativeBackend) runningPID() (int, error) {
+	if pid := b.PID(); pid != 0 {
+		return pid, nil
+	}
+	state, err := loadInstanceState()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read instance state: %w", err)
+	}
+	if state.PID == 0 {
+		return 0, fmt.Errorf("no server running (no process recorded in %s)", instanceFile)
+	}
+	if err := state.verifyProcess(); err != nil {
+		return 0, err
+	}
+	return state.PID, nil
+}
+
+func (b *nativeBackend) Health() error { return checkHealth(b.URL()) }
+
+func (b *nativeBackend) Logs(n int) ([]string, error) { return b.logs.Tail(n), nil }
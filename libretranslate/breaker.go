@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of a circuit breaker
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// errCircuitOpen is returned when every server that could take a request
+// has an open circuit
+type errCircuitOpen struct {
+	// retryAfter is the time until the first circuit lets a trial through
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("LibreTranslate is failing; circuit open, retry in %s", e.retryAfter.Round(time.Second))
+}
+
+// circuitBreaker stops sending requests to a server after consecutive
+// failures. Once OpenFor has passed a single trial request is let through;
+// it closes the circuit if it succeeds and opens it again otherwise. The
+// breaker is guarded by the pool's mutex.
+type circuitBreaker struct {
+	state     string
+	failures  int
+	openUntil time.Time
+	// trial is set while the request testing a half-open circuit is in flight
+	trial bool
+	trips int64
+}
+
+// ready reports whether a request may be sent through the circuit now
+func (b *circuitBreaker) ready(now time.Time) bool {
+	switch b.state {
+	case circuitOpen:
+		return !now.Before(b.openUntil)
+	case circuitHalfOpen:
+		return !b.trial
+	}
+	return true
+}
+
+// acquire lets a request through, making it the trial of a circuit whose
+// open time has passed
+func (b *circuitBreaker) acquire() {
+	if b.state == circuitOpen || b.state == circuitHalfOpen {
+		b.state = circuitHalfOpen
+		b.trial = true
+	}
+}
+
+// record counts the outcome of a request, returning true when it opened the
+// circuit
+func (b *circuitBreaker) record(cfg BreakerConfig, failed bool, now time.Time) bool {
+	if cfg.Failures <= 0 {
+		return false
+	}
+	if !failed {
+		b.state = circuitClosed
+		b.failures = 0
+		b.trial = false
+		return false
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state != circuitOpen && b.failures >= cfg.Failures) {
+		b.state = circuitOpen
+		b.openUntil = now.Add(time.Duration(cfg.OpenFor))
+		b.trial = false
+		b.trips++
+		return true
+	}
+	return false
+}
+
+// State returns the state of the circuit, closed when it was never used
+func (b *circuitBreaker) State() string {
+	if b.state == "" {
+		return circuitClosed
+	}
+	return b.state
+}
+
+// circuitValue exports a circuit state as 0 (closed), 1 (half open) or 2
+// (open)
+func circuitValue(state string) float64 {
+	switch state {
+	case circuitHalfOpen:
+		return 1
+	case circuitOpen:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	cfg := BreakerConfig{Failures: 2, OpenFor: Duration(time.Minute)}
+	now := time.Now()
+	var b circuitBreaker
+
+	if b.State() != circuitClosed || !b.ready(now) {
+		t.Fatalf("new circuit is %s", b.State())
+	}
+	if b.record(cfg, true, now) || b.State() != circuitClosed {
+		t.Fatalf("circuit opened after one failure: %s", b.State())
+	}
+	if !b.record(cfg, true, now) || b.State() != circuitOpen {
+		t.Fatalf("circuit %s after %d failures, want open", b.State(), cfg.Failures)
+	}
+	if b.ready(now) {
+		t.Fatal("open circuit lets requests through")
+	}
+
+	later := now.Add(time.Minute)
+	if !b.ready(later) {
+		t.Fatal("circuit lets no trial through once its open time has passed")
+	}
+	b.acquire()
+	if b.State() != circuitHalfOpen || b.ready(later) {
+		t.Fatalf("circuit %s lets a second request through its trial", b.State())
+	}
+	if !b.record(cfg, true, later) || b.State() != circuitOpen || b.trips != 2 {
+		t.Fatalf("failed trial left the circuit %s after %d trips", b.State(), b.trips)
+	}
+
+	b.acquire()
+	if b.record(cfg, false, later) || b.State() != circuitClosed || b.failures != 0 {
+		t.Fatalf("passed trial left the circuit %s with %d failures", b.State(), b.failures)
+	}
+
+	var disabled circuitBreaker
+	for i := 0; i < 10; i++ {
+		disabled.record(BreakerConfig{}, true, now)
+	}
+	if disabled.State() != circuitClosed {
+		t.Fatalf("disabled breaker is %s", disabled.State())
+	}
+}
+
+func TestPoolOpensCircuit(t *testing.T) {
+	b := startFake(t, FakeConfig{ErrorRate: 1})
+	openFor := 50 * time.Millisecond
+	p := newTestPool(t, b.URL(), nil, func(cfg *Config) {
+		cfg.Proxy.Retry.Attempts = 0
+		cfg.Proxy.Breaker = BreakerConfig{Failures: 2, OpenFor: Duration(openFor)}
+	})
+	body := []byte(`{"q": "Hello", "source": "en", "target": "es"}`)
+
+	for i := 0; i < 2; i++ {
+		if status, err := poolRequest(t, p, http.MethodPost, "/translate", body); err != nil || status != http.StatusServiceUnavailable {
+			t.Fatalf("failing translation answered %d, %v", status, err)
+		}
+	}
+	if circuit := memberStats(t, p, memberServer).Circuit; circuit != circuitOpen {
+		t.Fatalf("circuit %s after consecutive failures, want open", circuit)
+	}
+	var open *errCircuitOpen
+	if _, err := poolRequest(t, p, http.MethodPost, "/translate", body); !errors.As(err, &open) {
+		t.Fatalf("request through an open circuit returned %v", err)
+	}
+
+	// A failed trial opens the circuit again, a passed one closes it
+	time.Sleep(openFor)
+	poolRequest(t, p, http.MethodPost, "/translate", body)
+	if server := memberStats(t, p, memberServer); server.Circuit != circuitOpen || server.Trips != 2 {
+		t.Fatalf("circuit %s after %d trips, want open after 2", server.Circuit, server.Trips)
+	}
+	time.Sleep(openFor)
+	if status, err := poolRequest(t, p, http.MethodGet, "/languages", nil); err != nil || status != http.StatusOK {
+		t.Fatalf("trial request answered %d, %v", status, err)
+	}
+	if circuit := memberStats(t, p, memberServer).Circuit; circuit != circuitClosed {
+		t.Fatalf("circuit %s after a passed trial, want closed", circuit)
+	}
+}
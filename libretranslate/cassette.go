@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes and matching of the cassette
+const (
+	cassetteRecord = "record"
+	cassetteReplay = "replay"
+	matchStrict    = "strict"
+	matchLenient   = "lenient"
+)
+
+// errCassetteMiss is returned when no recorded exchange matches a request
+// being replayed
+type errCassetteMiss struct {
+	method, path, match string
+}
+
+func (e *errCassetteMiss) Error() string {
+	return fmt.Sprintf("no recorded exchange matches %s %s (%s matching)", e.method, e.path, e.match)
+}
+
+// unrecordedHeaders are response headers that describe one connection
+// rather than the answer, and are left out of the cassette
+var unrecordedHeaders = []string{"Date", "Set-Cookie", "Content-Length", "Connection", "Keep-Alive", "Transfer-Encoding"}
+
+// exchange is a request sent to LibreTranslate and what came back: a
+// response, or the error that took its place. It is one line of the
+// cassette.
+type exchange struct {
+	RecordedAt time.Time         `json:"recorded_at"`
+	DurationMs float64           `json:"duration_ms"`
+	Request    recordedRequest   `json:"request"`
+	Response   *recordedResponse `json:"response,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// recordedRequest is a request without its API key. Bodies are kept as
+// JSON when they are JSON, and as text otherwise.
+type recordedRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Query  string          `json:"query,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+type recordedResponse struct {
+	Status int             `json:"status"`
+	Header http.Header     `json:"header,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+// cassetteMiss describes requests that no recorded exchange matched
+type cassetteMiss struct {
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Body    string    `json:"body,omitempty"`
+	Count   int       `json:"count"`
+	FirstAt time.Time `json:"first_at"`
+	LastAt  time.Time `json:"last_at"`
+}
+
+// cassetteStats describes the cassette in the status API
+type cassetteStats struct {
+	Mode      string         `json:"mode"`
+	File      string         `json:"file"`
+	Match     string         `json:"match,omitempty"`
+	Exchanges int            `json:"exchanges"`
+	Replayed  int64          `json:"replayed"`
+	Unmatched []cassetteMiss `json:"unmatched"`
+}
+
+// lineKey identifies the translation of one text
+type lineKey struct {
+	source, target, text string
+}
+
+// cassette sits in front of the upstream pool. When recording it writes
+// every exchange on its routes to the file; when replaying it answers from
+// the file and never calls LibreTranslate.
+type cassette struct {
+	cfg  CassetteConfig
+	next http.RoundTripper
+
+	mu   sync.Mutex
+	file *os.File
+	// exchanges holds the recorded exchanges by request, in recording order,
+	// and played how many of each were replayed
+	exchanges map[string][]*exchange
+	played    map[string]int
+	count     int
+	// latest is the last exchange of each method and path, and lines the
+	// recorded translation of each text; both serve lenient matching
+	latest   map[string]*exchange
+	lines    map[lineKey]string
+	replayed int64
+	misses   map[string]*cassetteMiss
+}
+
+// newCassette creates the cassette configured in cfg in front of next, or
+// returns nil when neither recording nor replaying
+func newCassette(cfg CassetteConfig, next http.RoundTripper) (*cassette, error) {
+	if cfg.Mode == "" {
+		return nil, nil
+	}
+	if cfg.File == "" {
+		return nil, fmt.Errorf("the cassette needs a file")
+	}
+	if cfg.Match == "" {
+		cfg.Match = matchStrict
+	}
+	if cfg.Match != matchStrict && cfg.Match != matchLenient {
+		return nil, fmt.Errorf("unknown cassette matching %q (expected strict or lenient)", cfg.Match)
+	}
+
+	c := &cassette{
+		cfg:       cfg,
+		next:      next,
+		exchanges: make(map[string][]*exchange),
+		played:    make(map[string]int),
+		latest:    make(map[string]*exchange),
+		lines:     make(map[lineKey]string),
+		misses:    make(map[string]*cassetteMiss),
+	}
+	switch cfg.Mode {
+	case cassetteRecord:
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cassette: %w", err)
+		}
+		c.file = file
+		slog.Info("Recording upstream exchanges", "file", cfg.File, "routes", strings.Join(cfg.Routes, ","))
+	case cassetteReplay:
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+		slog.Info("Replaying upstream exchanges; LibreTranslate is not called", "file", cfg.File, "exchanges", c.count, "match", cfg.Match)
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q (expected record or replay)", cfg.Mode)
+	}
+	onShutdown(c.close)
+	return c, nil
+}
+
+// load reads the exchanges of the cassette file
+func (c *cassette) load() error {
+	file, err := os.Open(c.cfg.File)
+	if err != nil {
+		return fmt.Errorf("failed to open cassette: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 4*maxTranslateBody)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("invalid cassette %s, line %d: %w", c.cfg.File, n, err)
+		}
+		c.add(&e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read cassette: %w", err)
+	}
+	return nil
+}
+
+// add indexes e for replay
+func (c *cassette) add(e *exchange) {
+	key := e.Request.key()
+	c.exchanges[key] = append(c.exchanges[key], e)
+	c.latest[e.Request.Method+" "+e.Request.Path] = e
+	c.count++
+
+	if e.Request.Path != "/translate" || e.Response == nil || e.Response.Status != http.StatusOK {
+		return
+	}
+	var req struct {
+		Q      json.RawMessage `json:"q"`
+		Source string          `json:"source"`
+		Target string          `json:"target"`
+	}
+	var resp struct {
+		TranslatedText json.RawMessage `json:"translatedText"`
+	}
+	if json.Unmarshal(e.Request.Body, &req) != nil || json.Unmarshal(e.Response.Body, &resp) != nil {
+		return
+	}
+	texts, _ := jsonTexts(req.Q)
+	translated, _ := jsonTexts(resp.TranslatedText)
+	if len(texts) != len(translated) {
+		return
+	}
+	for i, text := range texts {
+		c.lines[lineKey{req.Source, req.Target, text}] = translated[i]
+		c.lines[lineKey{"", req.Target, text}] = translated[i]
+	}
+}
+
+// RoundTrip records or replays requests to the routes of the cassette, and
+// sends the others on
+func (c *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !c.covers(req.URL.Path) {
+		return c.next.RoundTrip(req)
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	recorded := newRecordedRequest(req, body)
+
+	if c.cfg.Mode == cassetteReplay {
+		return c.replay(req, recorded)
+	}
+
+	// A compressed answer could not be read back from the cassette
+	req.Header.Del("Accept-Encoding")
+	start := time.Now()
+	resp, err := c.next.RoundTrip(req)
+	e := &exchange{RecordedAt: start, Request: recorded}
+	if err != nil {
+		// A request abandoned by its client says nothing about LibreTranslate
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		e.Error = err.Error()
+	} else {
+		data, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			return nil, readErr
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		e.Response = newRecordedResponse(resp.StatusCode, resp.Header, data)
+	}
+	e.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+	c.write(e)
+	return resp, err
+}
+
+// Capture records an answer the proxy composed itself, such as the
+// languages of every shard merged
+func (c *cassette) Capture(req *http.Request, status int, header http.Header, body []byte, took time.Duration) {
+	if c.cfg.Mode != cassetteRecord || !c.covers(req.URL.Path) {
+		return
+	}
+	c.write(&exchange{
+		RecordedAt: time.Now().Add(-took),
+		DurationMs: float64(took) / float64(time.Millisecond),
+		Request:    newRecordedRequest(req, nil),
+		Response:   newRecordedResponse(status, header, body),
+	})
+}
+
+// write appends e to the cassette file
+func (c *cassette) write(e *exchange) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Warn("Could not record upstream exchange", "path", e.Request.Path, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		slog.Warn("Could not record upstream exchange", "path", e.Request.Path, "error", err)
+		return
+	}
+	c.count++
+}
+
+// replay answers req from the recorded exchanges
+func (c *cassette) replay(req *http.Request, recorded recordedRequest) (*http.Response, error) {
+	e, composed := c.match(recorded)
+	if e == nil && composed == nil {
+		c.miss(recorded)
+		return nil, &errCassetteMiss{method: recorded.Method, path: recorded.Path, match: c.cfg.Match}
+	}
+
+	if e != nil && c.cfg.ReplayLatency && e.DurationMs > 0 {
+		timer := time.NewTimer(time.Duration(e.DurationMs * float64(time.Millisecond)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	c.mu.Lock()
+	c.replayed++
+	c.mu.Unlock()
+
+	answer := composed
+	if e != nil {
+		if e.Response == nil {
+			return nil, fmt.Errorf("recorded error: %s", e.Error)
+		}
+		answer = e.Response
+	}
+	data := []byte(answer.Text)
+	if answer.Body != nil {
+		data = answer.Body
+	}
+	header := answer.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", answer.Status, http.StatusText(answer.Status)),
+		StatusCode:    answer.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+// match finds the exchange recorded for an identical request, the next one
+// when it was recorded several times. Lenient matching then composes a
+// translation from recorded lines, or for other routes takes the latest
+// exchange on the same route.
+func (c *cassette) match(recorded recordedRequest) (*exchange, *recordedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := recorded.key()
+	if exchanges := c.exchanges[key]; len(exchanges) > 0 {
+		i := min(c.played[key], len(exchanges)-1)
+		c.played[key]++
+		return exchanges[i], nil
+	}
+	if c.cfg.Match != matchLenient {
+		return nil, nil
+	}
+	if recorded.Path == "/translate" {
+		// Another translation would be a wrong answer, not a lenient one
+		return nil, c.composeLocked(recorded)
+	}
+	return c.latest[recorded.Method+" "+recorded.Path], nil
+}
+
+// composeLocked answers a translation from the recorded translations of
+// each of its texts, or returns nil when one is missing
+func (c *cassette) composeLocked(recorded recordedRequest) *recordedResponse {
+	var req struct {
+		Q      json.RawMessage `json:"q"`
+		Source string          `json:"source"`
+		Target string          `json:"target"`
+	}
+	if json.Unmarshal(recorded.Body, &req) != nil {
+		return nil
+	}
+	texts, batch := jsonTexts(req.Q)
+	if len(texts) == 0 {
+		return nil
+	}
+
+	var translated []string
+	for _, text := range texts {
+		line, ok := c.lines[lineKey{req.Source, req.Target, text}]
+		if !ok {
+			line, ok = c.lines[lineKey{"", req.Target, text}]
+		}
+		if !ok {
+			return nil
+		}
+		translated = append(translated, line)
+	}
+
+	var answer interface{} = map[string]interface{}{"translatedText": translated}
+	if !batch {
+		answer = map[string]interface{}{"translatedText": translated[0]}
+	}
+	body, _ := json.Marshal(answer)
+	return &recordedResponse{
+		Status: http.StatusOK,
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   body,
+	}
+}
+
+// miss counts a request that no exchange matched
+func (c *cassette) miss(recorded recordedRequest) {
+	body := string(recorded.Body) + recorded.Text
+	if len(body) > 200 {
+		body = body[:200] + "…"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	key := recorded.key()
+	m := c.misses[key]
+	if m == nil {
+		m = &cassetteMiss{Method: recorded.Method, Path: recorded.Path, Body: body, FirstAt: now}
+		c.misses[key] = m
+		slog.Warn("No recorded exchange matches the request", "method", recorded.Method, "path", recorded.Path, "body", body, "match", c.cfg.Match)
+	}
+	m.Count++
+	m.LastAt = now
+}
+
+// Stats describes the cassette and the requests it could not replay
+func (c *cassette) Stats() cassetteStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := cassetteStats{
+		Mode:      c.cfg.Mode,
+		File:      c.cfg.File,
+		Exchanges: c.count,
+		Replayed:  c.replayed,
+		Unmatched: []cassetteMiss{},
+	}
+	if c.cfg.Mode == cassetteReplay {
+		stats.Match = c.cfg.Match
+	}
+	for _, m := range c.misses {
+		stats.Unmatched = append(stats.Unmatched, *m)
+	}
+	sort.Slice(stats.Unmatched, func(i, j int) bool {
+		return stats.Unmatched[i].FirstAt.Before(stats.Unmatched[j].FirstAt)
+	})
+	return stats
+}
+
+// close ends the recording, or reports the requests that went unmatched
+func (c *cassette) close() {
+	stats := c.Stats()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+		slog.Info("Recording saved", "file", c.cfg.File, "exchanges", stats.Exchanges)
+		return
+	}
+
+	slog.Info("Replay finished", "file", c.cfg.File, "replayed", stats.Replayed, "unmatched", len(stats.Unmatched))
+	for _, m := range stats.Unmatched {
+		slog.Warn("Unmatched request", "method", m.Method, "path", m.Path, "body", m.Body, "count", m.Count)
+	}
+}
+
+// covers reports whether path is recorded and replayed
+func (c *cassette) covers(path string) bool {
+	for _, prefix := range c.cfg.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the body of req, leaving it in place to be sent
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// newRecordedRequest describes req for the cassette. The API key is left
+// out, and the body normalized, so that requests differing only in the key
+// or the order of fields match.
+func newRecordedRequest(req *http.Request, body []byte) recordedRequest {
+	recorded := recordedRequest{Method: req.Method, Path: req.URL.Path}
+	if query := req.URL.Query(); len(query) > 0 {
+		query.Del("api_key")
+		recorded.Query = query.Encode()
+	}
+	if len(body) == 0 {
+		return recorded
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	var fields map[string]interface{}
+	switch {
+	case json.Unmarshal(body, &fields) == nil:
+		delete(fields, "api_key")
+		recorded.Body, _ = json.Marshal(fields)
+	case json.Valid(body):
+		recorded.Body = compactJSON(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			recorded.Text = string(body)
+			break
+		}
+		form.Del("api_key")
+		recorded.Text = form.Encode()
+	default:
+		recorded.Text = string(body)
+	}
+	return recorded
+}
+
+// newRecordedResponse describes a response for the cassette
+func newRecordedResponse(status int, header http.Header, body []byte) *recordedResponse {
+	recorded := &recordedResponse{Status: status, Header: header.Clone()}
+	for _, name := range unrecordedHeaders {
+		recorded.Header.Del(name)
+	}
+	if json.Valid(body) {
+		recorded.Body = compactJSON(body)
+	} else {
+		recorded.Text = string(body)
+	}
+	return recorded
+}
+
+// key identifies identical requests
+func (r recordedRequest) key() string {
+	return r.Method + " " + r.Path + "?" + r.Query + "\n" + string(r.Body) + r.Text
+}
+
+// compactJSON removes the insignificant space of valid JSON
+func compactJSON(data []byte) json.RawMessage {
+	var buf bytes.Buffer
+	json.Compact(&buf, data)
+	return buf.Bytes()
+}
+
+// jsonTexts reads a text or a list of texts, as in the q parameter and the
+// translatedText answer of LibreTranslate, reporting whether it was a list
+func jsonTexts(raw json.RawMessage) ([]string, bool) {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}, false
+	}
+	var texts []string
+	if json.Unmarshal(raw, &texts) == nil {
+		return texts, true
+	}
+	return nil, false
+}
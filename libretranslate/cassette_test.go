@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cassetteTranslate sends a translation of q to es through c
+func cassetteTranslate(t *testing.T, c *cassette, baseURL string, q interface{}) (string, error) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"q": q, "source": "en", "target": "es"})
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/translate", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		TranslatedText json.RawMessage `json:"translatedText"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	return string(answer.TranslatedText), nil
+}
+
+func TestCassetteReplay(t *testing.T) {
+	b := startFake(t, FakeConfig{})
+	file := filepath.Join(t.TempDir(), "cassette.jsonl")
+	cfg := defaultConfig().Cassette
+	cfg.File = file
+
+	cfg.Mode = cassetteRecord
+	recorder, err := newCassette(cfg, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"Hello", "World"} {
+		if _, err := cassetteTranslate(t, recorder, b.URL(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.close()
+	if n := recorder.Stats().Exchanges; n != 2 {
+		t.Fatalf("recorded %d exchanges, want 2", n)
+	}
+
+	// Replaying never calls the server
+	b.Stop()
+	tests := []struct {
+		match string
+		q     interface{}
+		want  string
+	}{
+		{matchStrict, "Hello", `"[es] Hello"`},
+		{matchStrict, []string{"Hello", "World"}, ""},
+		{matchStrict, "Goodbye", ""},
+		{matchLenient, "World", `"[es] World"`},
+		{matchLenient, []string{"Hello", "World"}, `["[es] Hello","[es] World"]`},
+		{matchLenient, []string{"Hello", "Goodbye"}, ""},
+	}
+	for _, tt := range tests {
+		cfg.Mode, cfg.Match = cassetteReplay, tt.match
+		player, err := newCassette(cfg, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cassetteTranslate(t, player, b.URL(), tt.q)
+		var miss *errCassetteMiss
+		switch {
+		case tt.want == "" && !errors.As(err, &miss):
+			t.Errorf("%s replay of %v answered %s, %v; want a miss", tt.match, tt.q, got, err)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("%s replay of %v answered %s, %v; want %s", tt.match, tt.q, got, err, tt.want)
+		}
+		if misses := len(player.Stats().Unmatched); (tt.want == "") != (misses == 1) {
+			t.Errorf("%s replay of %v counted %d misses", tt.match, tt.q, misses)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of links in the fallback chain
+const (
+	linkLocal          = "local"
+	linkLibreTranslate = "libretranslate"
+	linkOpenAI         = "openai"
+)
+
+// backendHeader names the link of the chain that served a translation
+const backendHeader = "X-Translation-Backend"
+
+// languagesTTL is how long the language list of a link is trusted, and
+// languagesRetry how soon a list that could not be fetched is tried again
+const (
+	languagesTTL   = 10 * time.Minute
+	languagesRetry = 30 * time.Second
+)
+
+// chainLink is a translation backend of the chain. Its counters and
+// language list are guarded by mu.
+type chainLink struct {
+	name       string
+	kind       string
+	translator Translator
+
+	mu        sync.Mutex
+	known     []languageInfo
+	fetchedAt time.Time
+	fetchErr  error
+	served    int64
+	failed    int64
+	skipped   int64
+}
+
+// chainLinkStats describes a link in the status API
+type chainLinkStats struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Served  int64  `json:"served"`
+	Failed  int64  `json:"failed"`
+	Skipped int64  `json:"skipped"`
+}
+
+// translationChain sends a translation to each of its links in turn, until
+// one answers. Links that do not offer the language pair are skipped. Some
+// pairs may use their own order of links.
+type translationChain struct {
+	links []*chainLink
+	// pairs maps "source:target" patterns, where either side may be "*",
+	// to the links used for matching pairs
+	pairs    map[string][]*chainLink
+	requests *metricFamily
+}
+
+// newTranslationChain creates the chain configured in cfg, or returns nil
+// when none is. The local servers are reached through proxy.
+func newTranslationChain(cfg FallbackConfig, proxy *libreTranslateProxy, metrics *proxyMetrics) (*translationChain, error) {
+	if len(cfg.Chain) == 0 {
+		if len(cfg.Pairs) > 0 {
+			return nil, fmt.Errorf("fallback pairs need the backends to be listed in fallback.chain")
+		}
+		return nil, nil
+	}
+
+	c := &translationChain{
+		pairs: make(map[string][]*chainLink),
+		requests: metrics.registry.Counter("lts_translation_backend_requests_total",
+			"Translations handled by each backend of the fallback chain, by outcome (served, failed, skipped).", "backend", "outcome"),
+	}
+	byName := make(map[string]*chainLink)
+	for i, lc := range cfg.Chain {
+		link, err := newChainLink(lc, proxy)
+		if err != nil {
+			return nil, fmt.Errorf("fallback backend %d: %w", i+1, err)
+		}
+		if byName[link.name] != nil {
+			return nil, fmt.Errorf("fallback backend %q is declared twice", link.name)
+		}
+		byName[link.name] = link
+		c.links = append(c.links, link)
+	}
+
+	for pattern, names := range cfg.Pairs {
+		source, target, ok := strings.Cut(pattern, ":")
+		if !ok || source == "" || target == "" {
+			return nil, fmt.Errorf("invalid fallback pair %q (expected source:target, e.g. en:ja or *:zh)", pattern)
+		}
+		var links []*chainLink
+		for _, name := range names {
+			link := byName[name]
+			if link == nil {
+				return nil, fmt.Errorf("fallback pair %q: no backend named %q in fallback.chain", pattern, name)
+			}
+			links = append(links, link)
+		}
+		c.pairs[pattern] = links
+	}
+	return c, nil
+}
+
+// newChainLink creates the translator configured in lc
+func newChainLink(lc ChainLinkConfig, proxy *libreTranslateProxy) (*chainLink, error) {
+	link := &chainLink{name: lc.Name, kind: lc.Type}
+	if link.kind == "" {
+		link.kind = linkLibreTranslate
+	}
+	if link.kind == linkLocal {
+		if link.name == "" {
+			link.name = linkLocal
+		}
+		link.translator = &localTranslator{proxy: proxy}
+		return link, nil
+	}
+
+	u, err := url.Parse(lc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", lc.URL)
+	}
+	if link.name == "" {
+		link.name = u.Host
+	}
+	timeout := time.Duration(lc.Timeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+		if link.kind == linkOpenAI {
+			// Language models answer far slower than translation engines
+			timeout = time.Minute
+		}
+	}
+	baseURL := strings.TrimSuffix(u.String(), "/")
+	client := &http.Client{Timeout: timeout}
+
+	switch link.kind {
+	case linkLibreTranslate:
+		link.translator = &libreTranslator{baseURL: baseURL, apiKey: lc.APIKey, client: client}
+	case linkOpenAI:
+		link.translator, err = newOpenAITranslator(lc, baseURL, client)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q (expected local, libretranslate or openai)", link.kind)
+	}
+	return link, nil
+}
+
+// linksFor returns the links to try for pair: those of the most specific
+// matching pattern, or the whole chain in its order
+func (c *translationChain) linksFor(pair languagePair) []*chainLink {
+	for _, pattern := range []string{
+		pair.Source + ":" + pair.Target,
+		pair.Source + ":*",
+		"*:" + pair.Target,
+		"*:*",
+	} {
+		if links, ok := c.pairs[pattern]; ok {
+			return links
+		}
+	}
+	return c.links
+}
+
+// Translate answers req from the first link that offers its language pair
+// and does not fail. When every link fails, the answer describes each
+// failure. A full queue for the local servers lets the next link try, but
+// a passed deadline, a seek or a cancellation while queued is returned as
+// is: it concerns the request, not the link.
+func (c *translationChain) Translate(ctx context.Context, req *translateRequest) (*bufferedResponse, error) {
+	pair := languagePair{Source: req.Source, Target: req.Target}
+	var failures []string
+	for _, link := range c.linksFor(pair) {
+		if !link.supports(pair) {
+			link.count(&link.skipped)
+			c.requests.Inc(link.name, "skipped")
+			slog.Debug("Translation backend skipped: language pair not offered", "backend", link.name, "pair", pair.String())
+			continue
+		}
+
+		resp, err := link.translator.Translate(ctx, req)
+		if err == nil && !fallsThrough(resp) {
+			link.count(&link.served)
+			c.requests.Inc(link.name, "served")
+			resp.header.Set(backendHeader, link.name)
+			return resp, nil
+		}
+		if errors.Is(err, errDeadlinePassed) || errors.Is(err, errSeekedPast) || (err != nil && err == ctx.Err()) {
+			return nil, err
+		}
+
+		link.count(&link.failed)
+		c.requests.Inc(link.name, "failed")
+		reason := failureReason(resp, err)
+		failures = append(failures, link.name+": "+reason)
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn("Translation backend failed, trying the next one", "backend", link.name, "pair", pair.String(), "error", reason)
+	}
+
+	resp := newBufferedResponse()
+	if len(failures) == 0 {
+		writeJSONError(resp, http.StatusBadRequest, fmt.Sprintf("No translation backend offers %s", pair))
+	} else {
+		writeJSONError(resp, http.StatusServiceUnavailable, "All translation backends failed: "+strings.Join(failures, "; "))
+	}
+	return resp, nil
+}
+
+// Stats describes the links for the status API
+func (c *translationChain) Stats() []chainLinkStats {
+	var stats []chainLinkStats
+	for _, link := range c.links {
+		link.mu.Lock()
+		stats = append(stats, chainLinkStats{
+			Name:    link.name,
+			Type:    link.kind,
+			Served:  link.served,
+			Failed:  link.failed,
+			Skipped: link.skipped,
+		})
+		link.mu.Unlock()
+	}
+	return stats
+}
+
+// count increments one of the counters of l
+func (l *chainLink) count(n *int64) {
+	l.mu.Lock()
+	*n++
+	l.mu.Unlock()
+}
+
+// supports reports whether l offers pair. A link whose languages are not
+// known yet or cannot be listed is assumed to offer every pair, and is tried
+// anyway.
+func (l *chainLink) supports(pair languagePair) bool {
+	l.mu.Lock()
+	stale := time.Since(l.fetchedAt) > languagesTTL || (l.fetchErr != nil && time.Since(l.fetchedAt) > languagesRetry)
+	if stale {
+		// Other requests keep using what is known while the list is fetched
+		l.fetchedAt = time.Now()
+	}
+	l.mu.Unlock()
+
+	if stale {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		languages, err := l.translator.Languages(ctx)
+		cancel()
+		if err != nil {
+			slog.Debug("Could not list the languages of a translation backend", "backend", l.name, "error", err)
+		}
+		l.mu.Lock()
+		l.known, l.fetchErr, l.fetchedAt = languages, err, time.Now()
+		l.mu.Unlock()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fetchErr != nil || l.known == nil {
+		return true
+	}
+	return offersPair(l.known, pair)
+}
+
+// offersPair reports whether languages translate pair; a source of "auto"
+// needs some language translating to the target
+func offersPair(languages []languageInfo, pair languagePair) bool {
+	for _, language := range languages {
+		if pair.Source != "auto" && language.Code != pair.Source {
+			continue
+		}
+		for _, target := range language.Targets {
+			if target == pair.Target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fallsThrough reports whether resp means the backend could not translate:
+// it failed, is overloaded, refused our credentials or lacks the language
+func fallsThrough(resp *bufferedResponse) bool {
+	switch {
+	case resp.status >= 500:
+		return true
+	case resp.status == http.StatusTooManyRequests, resp.status == http.StatusUnauthorized, resp.status == http.StatusForbidden:
+		return true
+	case resp.status == http.StatusBadRequest:
+		return strings.Contains(resp.body.String(), "not supported")
+	}
+	return false
+}
+
+// failureReason describes why a link did not serve a translation
+func failureReason(resp *bufferedResponse, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	var answer struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(resp.body.Bytes(), &answer) == nil && answer.Error != "" {
+		return fmt.Sprintf("status %d: %s", resp.status, answer.Error)
+	}
+	return fmt.Sprintf("status %d", resp.status)
+}
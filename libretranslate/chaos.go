@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of faults
+const (
+	faultLatency  = "latency"
+	faultError    = "error"
+	faultReset    = "reset"
+	faultTruncate = "truncate"
+	faultSlowBody = "slow_body"
+)
+
+// chaosHeader names the faults injected into a response
+const chaosHeader = "X-Chaos-Fault"
+
+// defaultFaultDelay is the delay of latency and slow body faults without one
+const defaultFaultDelay = 2 * time.Second
+
+// bodyFaultRoutes answer with small JSON documents, which truncate and slow
+// body faults may hold in memory
+var bodyFaultRoutes = []string{"/translate", "/detect", "/languages"}
+
+// chaosInjector draws faults for the requests of the proxy. Its
+// configuration can be replaced while requests are served.
+type chaosInjector struct {
+	mu       sync.RWMutex
+	cfg      ChaosConfig
+	injected map[string]int64
+	faults   *metricFamily
+}
+
+// chaosStats describes the chaos mode in the status API
+type chaosStats struct {
+	ChaosConfig
+	Injected map[string]int64 `json:"injected"`
+}
+
+// newChaosInjector creates an injector with the faults of cfg
+func newChaosInjector(cfg ChaosConfig, metrics *proxyMetrics) (*chaosInjector, error) {
+	c := &chaosInjector{
+		injected: make(map[string]int64),
+		faults: metrics.registry.Counter("lts_chaos_faults_total",
+			"Faults injected by the chaos mode, by type (latency, error, reset, truncate, slow_body).", "route", "fault"),
+	}
+	if err := c.Set(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Set replaces the configuration after checking it
+func (c *chaosInjector) Set(cfg ChaosConfig) error {
+	for i, f := range cfg.Faults {
+		switch f.Type {
+		case faultLatency, faultError, faultReset, faultTruncate, faultSlowBody:
+		default:
+			return fmt.Errorf("chaos fault %d: unknown type %q (expected latency, error, reset, truncate or slow_body)", i+1, f.Type)
+		}
+		if f.Probability < 0 || f.Probability > 1 {
+			return fmt.Errorf("chaos fault %d: probability must be between 0 and 1, not %g", i+1, f.Probability)
+		}
+		if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+			return fmt.Errorf("chaos fault %d: invalid status %d", i+1, f.Status)
+		}
+		for _, pattern := range f.Pairs {
+			if source, target, ok := strings.Cut(pattern, ":"); !ok || source == "" || target == "" {
+				return fmt.Errorf("chaos fault %d: invalid pair %q (expected source:target, e.g. en:ja or *:zh)", i+1, pattern)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	was := c.cfg.Enabled
+	c.cfg = cfg
+	c.mu.Unlock()
+
+	if cfg.Enabled && !was {
+		slog.Warn("Chaos mode on: faults are injected into answers", "faults", len(cfg.Faults))
+	} else if !cfg.Enabled && was {
+		slog.Info("Chaos mode off")
+	}
+	return nil
+}
+
+// Config returns the current configuration
+func (c *chaosInjector) Config() ChaosConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg
+}
+
+// Stats describes the configuration and the faults injected so far
+func (c *chaosInjector) Stats() chaosStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := chaosStats{ChaosConfig: c.cfg, Injected: make(map[string]int64)}
+	for fault, n := range c.injected {
+		stats.Injected[fault] = n
+	}
+	return stats
+}
+
+// Serve answers r with next, after the latency drawn for it and through
+// the fault drawn for it, if any
+func (c *chaosInjector) Serve(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	cfg := c.Config()
+	if !cfg.Enabled {
+		next(w, r)
+		return
+	}
+
+	var (
+		delay    time.Duration
+		injected []string
+		fault    *ChaosFault
+		pair     *languagePair
+	)
+	for i := range cfg.Faults {
+		f := &cfg.Faults[i]
+		if !f.matchesRoute(r.URL.Path) {
+			continue
+		}
+		if (f.Type == faultTruncate || f.Type == faultSlowBody) && !slices.Contains(bodyFaultRoutes, r.URL.Path) {
+			continue
+		}
+		if len(f.Pairs) > 0 {
+			if pair == nil {
+				pair = peekPair(r)
+			}
+			if !f.matchesPair(pair) {
+				continue
+			}
+		}
+		if rand.Float64() >= f.Probability {
+			continue
+		}
+
+		c.count(r.URL.Path, f.Type)
+		injected = append(injected, f.Type)
+		if f.Type == faultLatency {
+			delay += f.delay()
+			continue
+		}
+		fault = f
+		break
+	}
+	if len(injected) == 0 {
+		next(w, r)
+		return
+	}
+	w.Header().Set(chaosHeader, strings.Join(injected, ", "))
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case fault == nil:
+		next(w, r)
+	case fault.Type == faultError:
+		status := fault.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSONError(w, status, "Fault injected by the chaos mode")
+	case fault.Type == faultReset:
+		resetConnection(w, r)
+	case fault.Type == faultTruncate:
+		rec := newBufferedResponse()
+		next(rec, r)
+		body := rec.body.Bytes()
+		writeBuffered(w, rec, body[:len(body)/2])
+	case fault.Type == faultSlowBody:
+		rec := newBufferedResponse()
+		next(rec, r)
+		trickle(w, r, rec, fault.delay())
+	}
+}
+
+// count records an injected fault
+func (c *chaosInjector) count(path, fault string) {
+	c.mu.Lock()
+	c.injected[fault]++
+	c.mu.Unlock()
+	c.faults.Inc(routeLabel(path), fault)
+}
+
+// matchesRoute reports whether the fault applies to path
+func (f *ChaosFault) matchesRoute(path string) bool {
+	if len(f.Routes) == 0 {
+		return true
+	}
+	for _, prefix := range f.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPair reports whether the fault applies to a translation of pair;
+// requests that are not translations have no pair
+func (f *ChaosFault) matchesPair(pair *languagePair) bool {
+	if pair == nil {
+		return false
+	}
+	for _, pattern := range f.Pairs {
+		source, target, _ := strings.Cut(pattern, ":")
+		if (source == "*" || source == pair.Source) && (target == "*" || target == pair.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the delay of a latency or slow body fault
+func (f *ChaosFault) delay() time.Duration {
+	if f.Delay <= 0 {
+		return defaultFaultDelay
+	}
+	return time.Duration(f.Delay)
+}
+
+// peekPair returns the language pair of a translation, leaving its body in
+// place, or nil for other requests
+func peekPair(r *http.Request) *languagePair {
+	if r.URL.Path != "/translate" || r.Method != http.MethodPost {
+		return nil
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil
+	}
+	peek := r.Clone(r.Context())
+	peek.Body = io.NopCloser(bytes.NewReader(body))
+	req, err := parseTranslateRequest(peek)
+	if err != nil {
+		return nil
+	}
+	return &languagePair{Source: req.Source, Target: req.Target}
+}
+
+// resetConnection closes the client connection without an answer, with a
+// TCP reset where possible
+func resetConnection(w http.ResponseWriter, r *http.Request) {
+	if info := infoFrom(r); info != nil {
+		info.aborted = true
+	}
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be taken over; abort the stream instead
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// writeBuffered writes the status and headers of rec, with body instead of
+// its own
+func writeBuffered(w http.ResponseWriter, rec *bufferedResponse, body []byte) {
+	for name, values := range rec.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Del("Content-Length")
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// trickle writes the body of rec in small pieces spread over d
+func trickle(w http.ResponseWriter, r *http.Request, rec *bufferedResponse, d time.Duration) {
+	body := rec.body.Bytes()
+	writeBuffered(w, rec, nil)
+
+	const pieces = 20
+	size := max(1, (len(body)+pieces-1)/pieces)
+	ticker := time.NewTicker(d / pieces)
+	defer ticker.Stop()
+	controller := http.NewResponseController(w)
+	controller.Flush()
+	for len(body) > 0 {
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+		n := min(size, len(body))
+		w.Write(body[:n])
+		controller.Flush()
+		body = body[n:]
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChaosFaults(t *testing.T) {
+	b := startFake(t, FakeConfig{})
+	p, srv := newTestProxy(t, b.URL(), nil)
+	inject := func(fault ChaosFault) {
+		t.Helper()
+		fault.Probability = 1
+		if err := p.chaos.Set(ChaosConfig{Enabled: true, Faults: []ChaosFault{fault}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	translate := func() (*http.Response, []byte, error) {
+		resp, err := http.Post(srv.URL+"/translate", "application/json",
+			strings.NewReader(`{"q": "Hello", "source": "en", "target": "es"}`))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	inject(ChaosFault{Type: faultError, Status: http.StatusInternalServerError})
+	resp, _, err := translate()
+	if err != nil || resp.StatusCode != http.StatusInternalServerError || resp.Header.Get(chaosHeader) != faultError {
+		t.Fatalf("error fault answered %v, %v", resp, err)
+	}
+
+	delay := 100 * time.Millisecond
+	inject(ChaosFault{Type: faultLatency, Delay: Duration(delay)})
+	start := time.Now()
+	resp, _, err = translate()
+	if err != nil || resp.StatusCode != http.StatusOK || time.Since(start) < delay {
+		t.Fatalf("latency fault answered %v, %v after %s", resp, err, time.Since(start))
+	}
+
+	inject(ChaosFault{Type: faultTruncate})
+	resp, body, _ := translate()
+	if resp == nil || json.Valid(body) {
+		t.Fatalf("truncate fault answered the whole body %q", body)
+	}
+	// Other routes may answer large bodies, which are never held back
+	settings, err := http.Get(srv.URL + "/frontend/settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(settings.Body)
+	settings.Body.Close()
+	if !json.Valid(body) || settings.Header.Get(chaosHeader) != "" {
+		t.Fatalf("truncate fault applied to the settings: %q", body)
+	}
+
+	inject(ChaosFault{Type: faultReset})
+	if _, _, err := translate(); err == nil {
+		t.Fatal("reset fault answered the request")
+	}
+	waitFor(t, "the reset to be recorded", func() bool {
+		var metrics bytes.Buffer
+		p.metrics.registry.WriteText(&metrics)
+		return strings.Contains(metrics.String(), `code="444"`)
+	})
+
+	stats := p.chaos.Stats()
+	for _, fault := range []string{faultError, faultLatency, faultTruncate, faultReset} {
+		if stats.Injected[fault] != 1 {
+			t.Errorf("%s fault injected %d times, want 1", fault, stats.Injected[fault])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flightGroup merges identical concurrent requests into one upstream call
+// whose result is shared with every waiter. The call is cancelled only when
+// all waiters have gone away.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+
+	requests int64
+	shared   int64
+}
+
+// flightCall is an upstream call in progress
+type flightCall struct {
+	done    chan struct{}
+	resp    *bufferedResponse
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+	// ticket is as urgent as the most urgent waiter
+	ticket *sharedTicket
+}
+
+// coalesceStats is a snapshot of the group exposed through the status API
+type coalesceStats struct {
+	Requests int64   `json:"requests"`
+	Shared   int64   `json:"shared"`
+	InFlight int     `json:"in_flight"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// newFlightGroup creates an empty flight group
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn once for all concurrent callers using the same key. fn gets a
+// context that outlives any single caller and is bounded by timeout, and
+// the ticket of the call, which callers joining it raise to their own.
+// shared reports whether the result came from another caller's call.
+func (g *flightGroup) Do(ctx context.Context, key string, timeout time.Duration, ticket scheduleTicket, fn func(context.Context, *sharedTicket) (*bufferedResponse, error)) (resp *bufferedResponse, shared bool, err error) {
+	g.mu.Lock()
+	g.requests++
+
+	call, ok := g.calls[key]
+	if ok {
+		g.shared++
+		call.waiters++
+		g.mu.Unlock()
+		call.ticket.Join(ticket)
+		resp, err := g.wait(ctx, key, call)
+		return resp, true, err
+	}
+
+	var callCtx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		callCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	} else {
+		callCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	call = &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel, ticket: newSharedTicket(ticket)}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	go func() {
+		call.resp, call.err = fn(callCtx, call.ticket)
+		cancel()
+
+		g.mu.Lock()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	resp, err = g.wait(ctx, key, call)
+	return resp, false, err
+}
+
+// wait blocks until call finishes or ctx is done. The last waiter to give up
+// cancels the call and lets later requests start a fresh one.
+func (g *flightGroup) wait(ctx context.Context, key string, call *flightCall) (*bufferedResponse, error) {
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns how often requests were merged
+func (g *flightGroup) Stats() coalesceStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stats := coalesceStats{Requests: g.requests, Shared: g.shared, InFlight: len(g.calls)}
+	if g.requests > 0 {
+		stats.HitRate = float64(g.shared) / float64(g.requests)
+	}
+	return stats
+}
+
+// coalesceKey identifies translation requests that can share one upstream
+// call: same texts, languages, options and upstream key. The scheduling
+// hints and the client address are left out; a session stays in, as
+// language models translate with the context of their session.
+func coalesceKey(req *translateRequest) (string, error) {
+	body, err := json.Marshal(struct {
+		Q            []string
+		Batch        bool
+		Source       string
+		Target       string
+		Format       string
+		Alternatives int
+		APIKey       string
+		Session      string
+	}{req.Q, req.Batch, req.Source, req.Target, req.Format, req.Alternatives, req.APIKey, req.Session})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// bufferedResponse records a response so it can be replayed to many clients
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newBufferedResponse creates an empty recorded response
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// Replay writes the recorded response to w
+func (b *bufferedResponse) Replay(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config holds the settings read from the configuration file
+type Config struct {
+	Backend  BackendConfig  `json:"backend"`
+	Proxy    ProxyConfig    `json:"proxy"`
+	CORS     CORSConfig     `json:"cors"`
+	Web      WebConfig      `json:"web"`
+	Keys     KeysConfig     `json:"keys"`
+	Limits   LimitsConfig   `json:"limits"`
+	Tracing  TracingConfig  `json:"tracing"`
+	Logging  LoggingConfig  `json:"logging"`
+	Idle     IdleConfig     `json:"idle"`
+	Warmup   WarmupConfig   `json:"warmup"`
+	Pool     PoolConfig     `json:"pool"`
+	Shards   []ShardConfig  `json:"shards"`
+	Fallback FallbackConfig `json:"fallback"`
+	Cassette CassetteConfig `json:"cassette"`
+	Chaos    ChaosConfig    `json:"chaos"`
+}
+
+// BackendConfig selects and configures the runtime that hosts LibreTranslate
+type BackendConfig struct {
+	// Type is one of "native", "container", "external" or "fake"
+	Type      string          `json:"type"`
+	Container ContainerConfig `json:"container"`
+	External  ExternalConfig  `json:"external"`
+	Fake      FakeConfig      `json:"fake"`
+	// StopTimeout is how long a stopping server may take to finish in-flight
+	// requests before it is killed
+	StopTimeout Duration `json:"stop_timeout"`
+	// Resources limits what the server may use of the machine
+	Resources ResourceConfig `json:"resources"`
+}
+
+// ResourceConfig limits the memory and CPU of the LibreTranslate server, so
+// it leaves room for video playback on the same machine
+type ResourceConfig struct {
+	// MemoryMB caps the memory of the server; 0 means no limit
+	MemoryMB int `json:"memory_mb"`
+	// CPUs caps CPU time as a number of cores, e.g. 1.5; 0 means no limit
+	CPUs float64 `json:"cpus"`
+	// Nice lowers the scheduling priority, from 0 (normal) to 19 (lowest)
+	Nice int `json:"nice"`
+	// Threads is the number of translation threads; 0 keeps the default
+	Threads int `json:"threads"`
+	// WarnPercent is the share of a limit above which usage is reported
+	WarnPercent int `json:"warn_percent"`
+}
+
+// ContainerConfig configures the container backend
+type ContainerConfig struct {
+	// Runtime is the docker-compatible CLI to use; detected when empty
+	Runtime string `json:"runtime"`
+	Image   string `json:"image"`
+	// Name prefixes the name of each container, which ends with its port
+	Name      string   `json:"name"`
+	ModelsDir string   `json:"models_dir"`
+	ExtraArgs []string `json:"extra_args"`
+}
+
+// ExternalConfig configures the external backend
+type ExternalConfig struct {
+	URL string `json:"url"`
+}
+
+// FakeConfig configures the fake backend, a LibreTranslate stand-in whose
+// answers are deterministic
+type FakeConfig struct {
+	// Mode is how texts are translated: "prefix" (default) puts the target
+	// code in front, e.g. "[de] Hello"; "reverse" reverses them; "table"
+	// looks them up in Table
+	Mode string `json:"mode"`
+	// Table is a JSON file mapping target codes to translations, e.g.
+	// {"de": {"Hello": "Hallo"}}; texts it lacks are prefixed
+	Table string `json:"table"`
+	// Languages are the codes offered, each translating to all others;
+	// empty offers en, es, fr and de
+	Languages []string `json:"languages"`
+	// Latency delays every translation and detection, plus a random extra
+	// delay of up to Jitter
+	Latency Duration `json:"latency"`
+	Jitter  Duration `json:"jitter"`
+	// ErrorRate is the share of translations and detections that fail with
+	// ErrorStatus (default 503), from 0 to 1
+	ErrorRate   float64 `json:"error_rate"`
+	ErrorStatus int     `json:"error_status"`
+}
+
+// ProxyConfig configures the reverse proxy in front of LibreTranslate
+type ProxyConfig struct {
+	// Allow lists the path prefixes that may be proxied; empty allows all
+	Allow []string `json:"allow"`
+	// Deny lists path prefixes that are never proxied, even when allowed
+	Deny []string `json:"deny"`
+	// Timeout bounds every proxied request without a route timeout
+	Timeout Duration `json:"timeout"`
+	// RouteTimeouts maps path prefixes to their own timeout
+	RouteTimeouts map[string]Duration `json:"route_timeouts"`
+	// ConnectTimeout bounds connecting to LibreTranslate, and HeaderTimeout
+	// the wait for response headers once a request is sent
+	ConnectTimeout Duration `json:"connect_timeout"`
+	HeaderTimeout  Duration `json:"header_timeout"`
+	// RouteConnectTimeouts and RouteHeaderTimeouts override them by path
+	// prefix
+	RouteConnectTimeouts map[string]Duration `json:"route_connect_timeouts"`
+	RouteHeaderTimeouts  map[string]Duration `json:"route_header_timeouts"`
+	Retry                RetryConfig         `json:"retry"`
+	Breaker              BreakerConfig       `json:"circuit_breaker"`
+}
+
+// RetryConfig controls how failed upstream requests are tried again
+type RetryConfig struct {
+	// Attempts is the number of retries after the first try; 0 disables them
+	Attempts int `json:"attempts"`
+	// Backoff is the delay before the first retry, doubled for each further
+	// one up to MaxBackoff; between half and all of it is waited, at random
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max_backoff"`
+	// Routes lists the POST routes, with the paths below them, that are safe
+	// to send twice, as translating the same text again changes nothing;
+	// GET is always retried
+	Routes []string `json:"routes"`
+}
+
+// BreakerConfig controls the circuit breaker kept for each upstream server
+type BreakerConfig struct {
+	// Failures is the number of consecutive failed requests that opens the
+	// circuit of a server; 0 disables the breaker
+	Failures int `json:"failures"`
+	// OpenFor is how long an open circuit rejects requests before a single
+	// trial request is let through
+	OpenFor Duration `json:"open_for"`
+}
+
+// CORSConfig controls which browser origins may call the proxy
+type CORSConfig struct {
+	// AllowedOrigins lists origins or patterns where "*" matches any text,
+	// e.g. "chrome-extension://*" or "https://*.netflix.com"
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	MaxAge           Duration `json:"max_age"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// AllowPrivateNetwork answers Chrome's Private Network Access preflights
+	AllowPrivateNetwork bool `json:"allow_private_network"`
+}
+
+// WebConfig configures the web interface and its management API
+type WebConfig struct {
+	// Bind is the address the web interface listens on
+	Bind string `json:"bind"`
+	// AllowedHosts lists the Host header values accepted by the dashboard and
+	// management API, guarding against DNS rebinding
+	AllowedHosts []string `json:"allowed_hosts"`
+	// TokenFile holds the bearer token required by the management API
+	TokenFile string `json:"token_file"`
+}
+
+// KeysConfig configures API keys checked by the /translate proxy
+type KeysConfig struct {
+	// File stores the keys created with the keys command
+	File string `json:"file"`
+	// Required rejects translation requests that carry no key
+	Required bool `json:"required"`
+	// UpstreamAPIKey is sent to LibreTranslate in place of the client's key
+	UpstreamAPIKey string `json:"upstream_api_key"`
+}
+
+// LimitsConfig bounds the load the proxy puts on LibreTranslate
+type LimitsConfig struct {
+	// Routes lists the path prefixes subject to the limits below
+	Routes []string `json:"routes"`
+	// MaxConcurrent is the number of requests sent upstream at once; zero
+	// disables the limit
+	MaxConcurrent int `json:"max_concurrent"`
+	// MaxQueue is the number of requests that may wait for a free slot
+	MaxQueue int `json:"max_queue"`
+	// RatePerSecond and Burst configure a token bucket per client; a rate of
+	// zero disables rate limiting
+	RatePerSecond float64 `json:"rate_per_second"`
+	Burst         int     `json:"burst"`
+	// RateBy is "ip" or "key"; keyless requests are always limited by IP
+	RateBy string `json:"rate_by"`
+}
+
+// TracingConfig configures OpenTelemetry tracing of proxied translations
+type TracingConfig struct {
+	// Exporter is "otlp", "stdout", "file" or empty to disable tracing
+	Exporter string `json:"exporter"`
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://localhost:4318
+	Endpoint string `json:"endpoint"`
+	// Headers are sent with every OTLP export, e.g. for authentication
+	Headers map[string]string `json:"headers"`
+	// File receives one JSON span per line with the file exporter
+	File        string `json:"file"`
+	ServiceName string `json:"service_name"`
+}
+
+// LoggingConfig configures the logs of the manager itself
+type LoggingConfig struct {
+	// Level is debug, info, warn or error
+	Level string `json:"level"`
+	// Format is "text" or "json"
+	Format string `json:"format"`
+	// File also receives every log line when set
+	File string `json:"file"`
+	// MaxSizeMB and MaxBackups control the rotation of File
+	MaxSizeMB  int `json:"max_size_mb"`
+	MaxBackups int `json:"max_backups"`
+}
+
+// Duration is a time.Duration that reads and writes strings like "30s"
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON accepts either a duration string or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// IdleConfig lets the web interface stop or suspend the server when no
+// translations arrive, and bring it back when they do
+type IdleConfig struct {
+	// After is how long the server may go without translations; 0 disables
+	// the idle policy
+	After Duration `json:"after"`
+	// Action is "stop", which frees memory, or "suspend", which pauses the
+	// server so that it frees CPU and resumes instantly
+	Action string `json:"action"`
+	// LazyStart starts a stopped server when a request for Routes arrives
+	LazyStart bool `json:"lazy_start"`
+	// Routes are the requests that count as activity and wake the server
+	Routes []string `json:"routes"`
+	// HoldTimeout is how long a request waits for a starting server before
+	// it is answered with 503 and Retry-After
+	HoldTimeout Duration `json:"hold_timeout"`
+}
+
+// WarmupConfig controls the test translations sent once a started server
+// answers, which load every model before the first real request needs it
+type WarmupConfig struct {
+	// Enabled runs the warm-up after every start; the server only counts as
+	// ready once it is done. It is off by default, as every pair loads a
+	// model.
+	Enabled bool `json:"enabled"`
+	// Pairs lists the pairs to warm up as "source:target"; empty warms up
+	// every pair the server offers
+	Pairs []string `json:"pairs"`
+	// Text is translated for every pair
+	Text string `json:"text"`
+	// Timeout bounds each test translation
+	Timeout Duration `json:"timeout"`
+	// HistoryFile keeps past results to compare latency across versions
+	HistoryFile string `json:"history_file"`
+}
+
+// PoolConfig lets the proxy spread requests over several LibreTranslate
+// servers: the managed one, servers run elsewhere and local replicas
+type PoolConfig struct {
+	// URLs are LibreTranslate servers run elsewhere, added to the pool
+	URLs []string `json:"urls"`
+	// MinReplicas and MaxReplicas bound the extra local servers the web
+	// interface runs next to the managed one; 0 runs none
+	MinReplicas int `json:"min_replicas"`
+	MaxReplicas int `json:"max_replicas"`
+	// ScaleUpQueue is the number of waiting requests per healthy server at
+	// which a replica is added
+	ScaleUpQueue int `json:"scale_up_queue"`
+	// ScaleDownAfter is how long the servers must have had spare capacity
+	// before a replica above the minimum is removed
+	ScaleDownAfter Duration `json:"scale_down_after"`
+	// HealthInterval is the time between active health checks
+	HealthInterval Duration `json:"health_interval"`
+	// EjectAfter consecutive failures take a server out of rotation, and
+	// AdmitAfter consecutive passed checks bring it back
+	EjectAfter int `json:"eject_after"`
+	AdmitAfter int `json:"admit_after"`
+}
+
+// ShardConfig is a local server that loads only some languages, so that
+// all of them need not fit in the memory of one process. Translations go to
+// the shard loading both their source and target.
+type ShardConfig struct {
+	Name string `json:"name"`
+	// LoadOnly are the language codes the shard loads, e.g. ["en", "ja"]
+	LoadOnly []string `json:"load_only"`
+}
+
+// FallbackConfig lists the translation backends /translate requests are
+// sent to in turn, until one of them answers
+type FallbackConfig struct {
+	// Chain is tried in order; empty sends every translation to the local
+	// server alone
+	Chain []ChainLinkConfig `json:"chain"`
+	// Pairs gives some language pairs their own order of backends, named
+	// as in Chain. Keys are "source:target", where either side may be "*".
+	Pairs map[string][]string `json:"pairs"`
+}
+
+// CassetteConfig records the exchanges of the proxy with LibreTranslate to
+// a file, or replays them without any LibreTranslate running
+type CassetteConfig struct {
+	// Mode is "record", "replay" or empty to do neither
+	Mode string `json:"mode"`
+	// File holds one recorded exchange per line; recording appends to it
+	File string `json:"file"`
+	// Match is "strict", which replays only identical requests, or
+	// "lenient", which also composes translations from recorded lines and
+	// answers other routes from their latest exchange
+	Match string `json:"match"`
+	// Routes lists the path prefixes recorded and replayed
+	Routes []string `json:"routes"`
+	// ReplayLatency delays each replayed answer by the time it took when
+	// recorded
+	ReplayLatency bool `json:"replay_latency"`
+}
+
+// ChaosConfig injects faults into the answers of the proxy, to see how
+// clients cope with a failing server. It can be changed at runtime through
+// /api/chaos.
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+	// Faults are drawn in order for each request. Latency adds up; the
+	// first other fault drawn is the one injected.
+	Faults []ChaosFault `json:"faults"`
+}
+
+// ChaosFault is a fault injected into some of the requests
+type ChaosFault struct {
+	// Type is "latency", "error", "reset", "truncate" or "slow_body"
+	Type string `json:"type"`
+	// Probability is the share of matching requests that get the fault,
+	// from 0 to 1
+	Probability float64 `json:"probability"`
+	// Routes lists path prefixes; empty matches every route
+	Routes []string `json:"routes,omitempty"`
+	// Pairs lists "source:target" translations, where either side may be
+	// "*"; empty matches every request
+	Pairs []string `json:"pairs,omitempty"`
+	// Delay is the latency added, or the time a slow body takes to arrive
+	Delay Duration `json:"delay,omitempty"`
+	// Status is the status code of an error, 503 by default
+	Status int `json:"status,omitempty"`
+}
+
+// ChainLinkConfig is a translation backend of the fallback chain
+type ChainLinkConfig struct {
+	// Name marks the responses of the backend; it defaults to the type for
+	// the local server and to the host name otherwise
+	Name string `json:"name"`
+	// Type is one of "local", "libretranslate" or "openai"
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+	// Timeout bounds each request to the backend; the local server uses the
+	// proxy timeouts instead
+	Timeout Duration `json:"timeout"`
+
+	// Model names the model of an OpenAI-compatible server
+	Model       string  `json:"model"`
+	Temperature float64 `json:"temperature"`
+	// BatchSize is the number of lines translated by one completion
+	BatchSize int `json:"batch_size"`
+	// ContextLines is the number of earlier lines of the same session given
+	// to the model, so that it follows the dialogue
+	ContextLines int `json:"context_lines"`
+	// Languages limits the pairs offered by a backend that cannot list
+	// them, such as a language model; empty offers every pair
+	Languages []string `json:"languages"`
+}
+
+// defaultConfig returns the configuration used when no file is present
+func defaultConfig() Config {
+	return Config{
+		Backend: BackendConfig{
+			Type:        "native",
+			StopTimeout: Duration(30 * time.Second),
+			Resources:   ResourceConfig{WarnPercent: 90},
+			Container: ContainerConfig{
+				Image:     "libretranslate/libretranslate:latest",
+				Name:      "libretranslate-server",
+				ModelsDir: filepath.Join(configDir(), "models"),
+			},
+		},
+		Proxy: ProxyConfig{
+			Timeout: Duration(60 * time.Second),
+			RouteTimeouts: map[string]Duration{
+				"/translate":      Duration(30 * time.Second),
+				"/translate_file": Duration(10 * time.Minute),
+			},
+			ConnectTimeout: Duration(5 * time.Second),
+			RouteHeaderTimeouts: map[string]Duration{
+				"/translate": Duration(12 * time.Second),
+				"/detect":    Duration(10 * time.Second),
+			},
+			Retry: RetryConfig{
+				Attempts:   2,
+				Backoff:    Duration(200 * time.Millisecond),
+				MaxBackoff: Duration(2 * time.Second),
+				Routes:     []string{"/translate", "/detect"},
+			},
+			Breaker: BreakerConfig{
+				Failures: 5,
+				OpenFor:  Duration(30 * time.Second),
+			},
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{
+				"chrome-extension://*",
+				"https://*.netflix.com",
+				"https://*.youtube.com",
+				"https://*.hulu.com",
+				"http://localhost:*",
+				"http://127.0.0.1:*",
+			},
+			AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+			AllowedHeaders: []string{
+				"Content-Type", "Authorization",
+				"X-Priority", "X-Deadline", "X-Session", "X-Cue-Time",
+				"traceparent", "tracestate",
+			},
+			MaxAge:              Duration(10 * time.Minute),
+			AllowCredentials:    false,
+			AllowPrivateNetwork: true,
+		},
+		Web: WebConfig{
+			Bind:         "127.0.0.1",
+			AllowedHosts: []string{"localhost", "127.0.0.1", "::1"},
+			TokenFile:    filepath.Join(configDir(), "token"),
+		},
+		Keys: KeysConfig{
+			File: filepath.Join(configDir(), "keys.json"),
+		},
+		Limits: LimitsConfig{
+			Routes:        []string{"/translate", "/detect", "/translate_file"},
+			MaxConcurrent: 4,
+			MaxQueue:      64,
+			RateBy:        "key",
+		},
+		Tracing: TracingConfig{
+			Endpoint:    "http://localhost:4318",
+			File:        filepath.Join(configDir(), "traces.jsonl"),
+			ServiceName: "libretranslate-server",
+		},
+		Logging: LoggingConfig{
+			Level:      "info",
+			Format:     "text",
+			MaxSizeMB:  10,
+			MaxBackups: 3,
+		},
+		Idle: IdleConfig{
+			Action:      "stop",
+			Routes:      []string{"/translate", "/translate_file", "/detect"},
+			HoldTimeout: Duration(20 * time.Second),
+		},
+		Cassette: CassetteConfig{
+			File:   filepath.Join(configDir(), "cassette.jsonl"),
+			Match:  "strict",
+			Routes: []string{"/translate", "/languages"},
+		},
+		Warmup: WarmupConfig{
+			Text:        "Hello, how are you?",
+			Timeout:     Duration(2 * time.Minute),
+			HistoryFile: filepath.Join(configDir(), "warmup_history.json"),
+		},
+		Pool: PoolConfig{
+			ScaleUpQueue:   4,
+			ScaleDownAfter: Duration(5 * time.Minute),
+			HealthInterval: Duration(5 * time.Second),
+			EjectAfter:     3,
+			AdmitAfter:     2,
+		},
+	}
+}
+
+// configDir returns the directory holding the configuration and local data
+func configDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "libretranslate-server")
+}
+
+// defaultConfigPath returns the path of the configuration file
+func defaultConfigPath() string {
+	return filepath.Join(configDir(), "config.json")
+}
+
+// loadConfig reads the configuration file, falling back to defaults when it
+// does not exist
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if err := cfg.Pool.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// validate rejects pool settings that would quietly turn off health checks
+func (c PoolConfig) validate() error {
+	if c.HealthInterval <= 0 {
+		return fmt.Errorf("pool.health_interval must be positive, not %s", time.Duration(c.HealthInterval))
+	}
+	if c.EjectAfter < 1 || c.AdmitAfter < 1 {
+		return fmt.Errorf("pool.eject_after and pool.admit_after must be at least 1")
+	}
+	return nil
+}
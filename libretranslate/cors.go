@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// exposedHeaders are the response headers of the proxy that pages may read
+const exposedHeaders = "Retry-After, X-Chaos-Fault, X-Coalesced, X-Scheduler-Status, X-Translation-Backend"
+
+// corsPolicy decides which browser origins may use the proxy
+type corsPolicy struct {
+	cfg CORSConfig
+}
+
+// corsDecision describes what a given origin is allowed to do
+type corsDecision struct {
+	Origin         string
+	Allowed        bool
+	MatchedPattern string
+	Methods        []string
+	Headers        []string
+	Credentials    bool
+	PrivateNetwork bool
+	MaxAge         time.Duration
+}
+
+// newCORSPolicy creates a policy from the configuration
+func newCORSPolicy(cfg CORSConfig) *corsPolicy {
+	return &corsPolicy{cfg: cfg}
+}
+
+// Check returns the decision for origin
+func (c *corsPolicy) Check(origin string) corsDecision {
+	d := corsDecision{Origin: origin}
+
+	for _, pattern := range c.cfg.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			d.Allowed = true
+			d.MatchedPattern = pattern
+			break
+		}
+	}
+
+	if d.Allowed {
+		d.Methods = c.cfg.AllowedMethods
+		d.Headers = c.cfg.AllowedHeaders
+		d.Credentials = c.cfg.AllowCredentials
+		d.PrivateNetwork = c.cfg.AllowPrivateNetwork
+		d.MaxAge = time.Duration(c.cfg.MaxAge)
+	}
+
+	return d
+}
+
+// Handle sets the CORS headers for r and answers preflight and rejected
+// requests itself. It returns false when the request must not be processed
+// any further.
+func (c *corsPolicy) Handle(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	// Requests without an Origin do not come from a browser page
+	if origin == "" {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+			return false
+		}
+		return true
+	}
+
+	d := c.Check(origin)
+	if !d.Allowed {
+		slog.Warn("Rejected CORS request", "origin", origin, "method", r.Method, "path", r.URL.Path)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if d.Credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+		return true
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(d.Methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(d.Headers, ", "))
+	if d.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(d.MaxAge.Seconds())))
+	}
+
+	// Required for Private Network Access (Chrome 94+)
+	if r.Header.Get("Access-Control-Request-Private-Network") == "true" {
+		if !d.PrivateNetwork {
+			slog.Warn("Rejected private network request", "origin", origin)
+			http.Error(w, "Private network access not allowed", http.StatusForbidden)
+			return false
+		}
+		w.Header().Set("Access-Control-Allow-Private-Network", "true")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+// matchOrigin reports whether origin matches pattern, where "*" matches any
+// sequence of characters
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == origin
+	}
+
+	if !strings.HasPrefix(origin, parts[0]) {
+		return false
+	}
+	rest := origin[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+// printCORSDecision prints what an origin is allowed to do
+func printCORSDecision(d corsDecision) {
+	if !d.Allowed {
+		color.Red("❌ Origin %s is not allowed\n", d.Origin)
+		return
+	}
+
+	color.Green("✅ Origin %s is allowed (matches %q)\n", d.Origin, d.MatchedPattern)
+	color.White("   Methods:         %s\n", strings.Join(d.Methods, ", "))
+	color.White("   Headers:         %s\n", strings.Join(d.Headers, ", "))
+	color.White("   Credentials:     %t\n", d.Credentials)
+	color.White("   Private network: %t\n", d.PrivateNetwork)
+	color.White("   Preflight cache: %v\n", d.MaxAge)
+}
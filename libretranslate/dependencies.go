@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,7 +14,7 @@ import (
 
 // checkDependencies checks if required dependencies are installed
 func checkDependencies() error {
-	color.Cyan("🔍 Checking dependencies...\n")
+	slog.Info("Checking dependencies")
 
 	// Check Python
 	if err := checkPython(); err != nil {
@@ -30,7 +31,7 @@ func checkDependencies() error {
 		return err
 	}
 
-	color.Green("✅ All dependencies are installed\n")
+	slog.Info("All dependencies are installed")
 	return nil
 }
 
@@ -38,24 +39,24 @@ func checkDependencies() error {
 func installDependencies() error {
 	// Check Python first
 	if err := checkPython(); err != nil {
-		color.Yellow("⚠️  Python not found\n")
+		slog.Warn("Python not found")
 		printPythonInstallInstructions()
 		return fmt.Errorf("please install Python 3.8+ first")
 	}
 
 	// Check pip
 	if err := checkPip(); err != nil {
-		color.Yellow("⚠️  pip not found\n")
+		slog.Warn("pip not found")
 		return fmt.Errorf("please install pip first")
 	}
 
 	// Install LibreTranslate
-	color.Cyan("📦 Installing LibreTranslate...\n")
+	slog.Info("Installing LibreTranslate")
 	if err := installLibreTranslate(); err != nil {
 		return err
 	}
 
-	color.Green("✅ LibreTranslate installed successfully\n")
+	slog.Info("LibreTranslate installed successfully")
 	return nil
 }
 
@@ -70,7 +71,7 @@ func checkPython() error {
 	}
 
 	version := string(output)
-	color.Green("  ✓ Python: %s", version)
+	slog.Info("Found Python", "version", strings.TrimSpace(version))
 
 	// Basic version check
 	if !strings.Contains(version, "Python 3.") {
@@ -91,7 +92,7 @@ func checkPip() error {
 	}
 
 	version := string(output)
-	color.Green("  ✓ pip: %s", strings.TrimSpace(version))
+	slog.Info("Found pip", "version", strings.TrimSpace(version))
 	return nil
 }
 
@@ -116,7 +117,7 @@ func checkLibreTranslate() error {
 		version = "installed"
 	}
 
-	color.Green("  ✓ LibreTranslate: %s\n", version)
+	slog.Info("Found LibreTranslate", "version", version)
 	return nil
 }
 
@@ -178,8 +179,7 @@ func getLibreTranslateCommand() string {
 func installLibreTranslate() error {
 	pipCmd := getPipCommand()
 
-	color.Cyan("  Installing libretranslate package...\n")
-	color.Yellow("  This may take several minutes as it downloads language models...\n\n")
+	slog.Info("Installing libretranslate package; this may take several minutes as it downloads language models")
 
 	cmd := exec.Command(pipCmd, "install", "libretranslate")
 	cmd.Stdout = color.Output
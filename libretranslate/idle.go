@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of the server as seen by the idle policy
+const (
+	idleRunning   = "running"
+	idleSuspended = "suspended"
+	idleStopped   = "stopped"
+	idleStarting  = "starting"
+	idleStopping  = "stopping"
+)
+
+// idleManager applies the idle policy of the web interface. It stops or
+// suspends the server once no translations have arrived for a while, and
+// brings it back when the proxy receives the next one.
+type idleManager struct {
+	cfg         IdleConfig
+	transitions *metricFamily
+
+	mu           sync.Mutex
+	state        string
+	lastActivity time.Time
+	// ready is closed when the start, resume or stop in progress succeeds
+	// or fails
+	ready    chan struct{}
+	startErr error
+}
+
+// newIdleManager creates the idle policy described by cfg, or returns nil
+// when it is disabled
+func newIdleManager(cfg IdleConfig, backend string, sharded bool, metrics *proxyMetrics) *idleManager {
+	if cfg.After <= 0 && !cfg.LazyStart {
+		return nil
+	}
+	if backend == "external" {
+		slog.Warn("Idle policy ignored: an external server is not managed by this tool")
+		return nil
+	}
+	if sharded {
+		slog.Warn("Idle policy ignored: shards run for as long as the web interface")
+		return nil
+	}
+
+	m := &idleManager{
+		cfg:          cfg,
+		state:        idleStopped,
+		lastActivity: time.Now(),
+		transitions: metrics.registry.Counter("lts_idle_transitions_total",
+			"Times the idle policy stopped, suspended, resumed or started the server.", "action"),
+	}
+	if isServerRunning(serverPort()) {
+		m.state = idleRunning
+	}
+	if state, err := loadInstanceState(); err == nil && state.Suspended {
+		m.state = idleSuspended
+	}
+	go m.run()
+	return m
+}
+
+// run checks for idleness at a quarter of the idle time, between 1 and 30
+// seconds
+func (m *idleManager) run() {
+	interval := time.Duration(m.cfg.After) / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > 30*time.Second || m.cfg.After <= 0 {
+		interval = 30 * time.Second
+	}
+	for range time.Tick(interval) {
+		m.tick()
+	}
+}
+
+// tick notices servers started or stopped behind the policy's back, and puts
+// the server to sleep once it has been idle long enough
+func (m *idleManager) tick() {
+	m.mu.Lock()
+	before := m.state
+	m.mu.Unlock()
+	if before == idleStarting || before == idleStopping || before == idleSuspended {
+		return
+	}
+
+	// Probe without the lock so requests are not held up meanwhile
+	running := isServerRunning(serverPort())
+
+	m.mu.Lock()
+	if m.state != before {
+		// A request started or resumed the server during the probe
+		m.mu.Unlock()
+		return
+	}
+	if !running {
+		m.state = idleStopped
+		m.mu.Unlock()
+		return
+	}
+	m.state = idleRunning
+
+	idle := time.Since(m.lastActivity)
+	if m.cfg.After <= 0 || idle < time.Duration(m.cfg.After) {
+		m.mu.Unlock()
+		return
+	}
+	// Requests arriving meanwhile wait for the server to settle
+	m.state = idleStopping
+	m.ready = make(chan struct{})
+	m.mu.Unlock()
+
+	m.sleep(idle)
+}
+
+// sleep suspends or stops the idle server, which is in the stopping state
+func (m *idleManager) sleep(idle time.Duration) {
+	state := idleRunning
+	defer func() {
+		m.mu.Lock()
+		m.state = state
+		close(m.ready)
+		m.mu.Unlock()
+	}()
+
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: serverPort()})
+	if err != nil {
+		return
+	}
+	idle = idle.Round(time.Second)
+
+	if m.cfg.Action == "suspend" {
+		if s, ok := b.(suspender); ok {
+			err := s.Suspend()
+			if err == nil {
+				setSuspended(true)
+				state = idleSuspended
+				m.transitions.Inc("suspend")
+				slog.Info("Suspended idle server", "idle", idle)
+				return
+			}
+			slog.Warn("Could not suspend idle server, stopping it instead", "error", err)
+		}
+	}
+
+	if err := b.Stop(); err != nil {
+		slog.Warn("Could not stop idle server", "error", err)
+		return
+	}
+	state = idleStopped
+	m.transitions.Inc("stop")
+	slog.Info("Stopped idle server", "idle", idle)
+}
+
+// Admit makes sure the server is up before r is proxied. It resumes a
+// suspended server, and starts a stopped one for requests that wake it,
+// holding the request for up to the hold timeout. When the server is not
+// ready in time, Admit answers r itself and returns false.
+func (m *idleManager) Admit(w http.ResponseWriter, r *http.Request) bool {
+	wakes := m.wakes(r.URL.Path)
+
+	m.mu.Lock()
+	if wakes {
+		m.lastActivity = time.Now()
+	}
+	for m.state == idleStopping {
+		// Let the server go to sleep before waking it again
+		settled := m.ready
+		m.mu.Unlock()
+		select {
+		case <-settled:
+		case <-r.Context().Done():
+			return false
+		}
+		m.mu.Lock()
+	}
+	if m.state == idleSuspended {
+		m.resumeLocked()
+	}
+	state := m.state
+	if state == idleStopped && wakes && m.cfg.LazyStart {
+		m.startLocked()
+		state = m.state
+	}
+	ready := m.ready
+	m.mu.Unlock()
+
+	switch state {
+	case idleRunning:
+		return true
+	case idleStopped:
+		if !m.cfg.LazyStart {
+			// Let the request fail upstream as it would without the policy
+			return true
+		}
+		writeJSONError(w, http.StatusServiceUnavailable, "LibreTranslate is stopped while idle; the next translation request starts it")
+		return false
+	}
+
+	hold := time.NewTimer(time.Duration(m.cfg.HoldTimeout))
+	defer hold.Stop()
+	select {
+	case <-ready:
+		m.mu.Lock()
+		err := m.startErr
+		m.mu.Unlock()
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("LibreTranslate failed to start: %v", err))
+			return false
+		}
+		return true
+	case <-hold.C:
+		writeStarting(w)
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// wakes reports whether a request for path counts as activity
+func (m *idleManager) wakes(path string) bool {
+	for _, route := range m.cfg.Routes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeLocked continues a suspended server in the background, and
+// requests wait for it as for a start; m.mu must be held
+func (m *idleManager) resumeLocked() {
+	m.state = idleStarting
+	m.ready = make(chan struct{})
+	m.startErr = nil
+	go m.resume()
+}
+
+// resume continues the suspended server. When it is gone, it is started
+// again if the policy starts servers, or left stopped.
+func (m *idleManager) resume() {
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: serverPort()})
+	if err == nil {
+		s, ok := b.(suspender)
+		if !ok {
+			err = errors.New("backend cannot be resumed")
+		} else {
+			err = s.Resume()
+		}
+	}
+	setSuspended(false)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.state = idleRunning
+		m.transitions.Inc("resume")
+		slog.Info("Resumed server for incoming request")
+		close(m.ready)
+		return
+	}
+	slog.Warn("Could not resume server", "error", err)
+	if m.cfg.LazyStart {
+		// The requests waiting for the resume wait for the start instead
+		m.launch()
+		return
+	}
+	m.state = idleStopped
+	m.startErr = err
+	close(m.ready)
+}
+
+// startLocked starts the server in the background; m.mu must be held
+func (m *idleManager) startLocked() {
+	m.state = idleStarting
+	m.ready = make(chan struct{})
+	m.startErr = nil
+	m.launch()
+}
+
+// launch starts the server for the start in progress, closing m.ready once
+// it is ready or has failed
+func (m *idleManager) launch() {
+	m.transitions.Inc("start")
+	slog.Info("Starting server for incoming request")
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- startServer("127.0.0.1", serverPort(), false)
+	}()
+	go m.awaitReady(exited)
+}
+
+// awaitReady waits for the server being started to be ready, warm-up
+// included, or to exit
+func (m *idleManager) awaitReady(exited <-chan error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+wait:
+	for {
+		select {
+		case err = <-exited:
+			// startServer returns at once when the server was already up
+			if isServerReady(serverPort()) {
+				err = nil
+			} else if err == nil {
+				err = errors.New("server exited before it was ready")
+			}
+			break wait
+		case <-ticker.C:
+			if isServerReady(serverPort()) {
+				break wait
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		slog.Warn("Server started for a request failed", "error", err)
+		m.state = idleStopped
+	} else {
+		m.state = idleRunning
+	}
+	m.startErr = err
+	close(m.ready)
+}
+
+// Status describes the idle policy for the dashboard
+func (m *idleManager) Status() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":         m.state,
+		"after_secs":    time.Duration(m.cfg.After).Seconds(),
+		"action":        m.cfg.Action,
+		"lazy_start":    m.cfg.LazyStart,
+		"idle_for_secs": math.Round(time.Since(m.lastActivity).Seconds()),
+	}
+}
+
+// setSuspended records in the instance state whether the server is paused,
+// so that other commands do not mistake it for a hung server
+func setSuspended(suspended bool) {
+	state, err := loadInstanceState()
+	if err != nil {
+		return
+	}
+	state.Suspended = suspended
+	if err := state.save(); err != nil {
+		slog.Warn("Could not save instance state", "error", err)
+	}
+}
+
+// writeStarting answers a request that could not wait for the server to
+// start, with the startup progress and a hint of when to retry
+func writeStarting(w http.ResponseWriter) {
+	retry := 5
+	body := map[string]interface{}{"error": "LibreTranslate is starting, retry later"}
+	if progress, err := readProgress(); err == nil {
+		body["progress"] = progress
+		if progress.ETA != nil && *progress.ETA > 0 {
+			retry = int(math.Ceil(*progress.ETA))
+			if retry > 60 {
+				retry = 60
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(body)
+}
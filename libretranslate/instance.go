@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// instanceFile records the last server started by this tool
+var instanceFile = filepath.Join(os.TempDir(), "libretranslate.json")
+
+// instanceState describes the server started by this tool so that other
+// commands, such as the web interface, can report on it
+type instanceState struct {
+	// PID and Identity name the server process when this tool runs it
+	PID       int          `json:"pid,omitempty"`
+	Identity  procIdentity `json:"identity"`
+	Port      int          `json:"port"`
+	Backend   string       `json:"backend"`
+	StartedAt time.Time    `json:"started_at"`
+	ReadyAt   time.Time    `json:"ready_at,omitempty"`
+	// Starts counts every start, so restarts show up in metrics
+	Starts int `json:"starts"`
+	// Limits are the resource limits applied to the server
+	Limits *resourceLimits `json:"limits,omitempty"`
+	// Suspended is set while the idle policy has paused the server
+	Suspended bool `json:"suspended,omitempty"`
+	// Warmup holds the latencies measured before the server became ready
+	Warmup *warmupResult `json:"warmup,omitempty"`
+}
+
+// loadInstanceState reads the instance file, returning an empty state when
+// no server has been started yet
+func loadInstanceState() (*instanceState, error) {
+	data, err := os.ReadFile(instanceFile)
+	if os.IsNotExist(err) {
+		return &instanceState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &instanceState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save writes the state to the instance file
+func (s *instanceState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(instanceFile, data, 0644)
+}
+
+// LoadTime returns how long the server took to become ready
+func (s *instanceState) LoadTime() time.Duration {
+	if s.ReadyAt.IsZero() || s.ReadyAt.Before(s.StartedAt) {
+		return 0
+	}
+	return s.ReadyAt.Sub(s.StartedAt)
+}
+
+// Warming reports whether the server recorded as started on port has yet
+// to become ready; it answers /languages while it warms up
+func (s *instanceState) Warming(port int) bool {
+	return s.Port == port && !s.StartedAt.IsZero() && s.ReadyAt.Before(s.StartedAt)
+}
+
+// procIdentity tells a process apart from a later one reusing its PID
+type procIdentity struct {
+	StartTime string `json:"start_time"`
+	Cmdline   string `json:"cmdline"`
+}
+
+// verifyProcess checks that the recorded PID still belongs to the server
+// this tool started, so that signals never reach an unrelated process
+func (s *instanceState) verifyProcess() error {
+	current, err := processIdentity(s.PID)
+	if err != nil {
+		return fmt.Errorf("process %d is not running", s.PID)
+	}
+	if current.StartTime != s.Identity.StartTime || current.Cmdline != s.Identity.Cmdline {
+		return fmt.Errorf("process %d is no longer the LibreTranslate server (now %q)", s.PID, current.Cmdline)
+	}
+	return nil
+}
+
+// clearInstanceProcess forgets the server process pid once it has exited.
+// Other processes, such as replicas of the server, leave the state alone.
+func clearInstanceProcess(pid int) {
+	state, err := loadInstanceState()
+	if err != nil || state.PID == 0 || state.PID != pid {
+		return
+	}
+	state.PID = 0
+	state.Identity = procIdentity{}
+	state.Suspended = false
+	state.save()
+}
+
+// procStats is the resource usage of a server process and the other
+// processes in its group
+type procStats struct {
+	RSSBytes   uint64
+	CPUSeconds float64
+	Threads    int
+	Processes  int
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// APIKey is a key handed out to a client of the proxy
+type APIKey struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Pairs lists allowed "source-target" pairs; "*" matches any code
+	Pairs  []string  `json:"pairs,omitempty"`
+	Quotas KeyQuotas `json:"quotas"`
+}
+
+// KeyQuotas limits how much a key may translate; zero means unlimited
+type KeyQuotas struct {
+	CharsPerMinute    int `json:"chars_per_minute,omitempty"`
+	CharsPerDay       int `json:"chars_per_day,omitempty"`
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	RequestsPerDay    int `json:"requests_per_day,omitempty"`
+}
+
+// keyUsage counts what a key used in the current minute and day
+type keyUsage struct {
+	minute         time.Time
+	day            time.Time
+	minuteChars    int
+	minuteRequests int
+	dayChars       int
+	dayRequests    int
+}
+
+// keyError is an authorization failure with its HTTP status
+type keyError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *keyError) Error() string { return e.message }
+
+// keyStore holds the API keys and meters their use. Keys are persisted in a
+// JSON file; usage is kept in memory.
+type keyStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	keys    []*APIKey
+	usage   map[string]*keyUsage
+}
+
+// loadKeyStore reads the keys saved at path
+func loadKeyStore(path string) (*keyStore, error) {
+	s := &keyStore{path: path, usage: make(map[string]*keyUsage)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the key file again when it changed on disk
+func (s *keyStore) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read keys: %w", err)
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read keys: %w", err)
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid key file %s: %w", s.path, err)
+	}
+
+	s.keys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the keys to disk, readable only by the owner
+func (s *keyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save keys: %w", err)
+	}
+	return nil
+}
+
+// Create adds a new key and returns its secret, which is not stored
+func (s *keyStore) Create(key APIKey) (string, *APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return "", nil, err
+	}
+
+	id := make([]byte, 4)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	key.ID = hex.EncodeToString(id)
+	key.CreatedAt = time.Now()
+	full := "lts_" + key.ID + "_" + hex.EncodeToString(secret)
+	key.Hash = hashKey(full)
+
+	s.keys = append(s.keys, &key)
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	return full, &key, nil
+}
+
+// Revoke marks the key with the given ID as revoked
+func (s *keyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	for _, key := range s.keys {
+		if key.ID == id {
+			if key.RevokedAt != nil {
+				return fmt.Errorf("key %s is already revoked", id)
+			}
+			now := time.Now()
+			key.RevokedAt = &now
+			return s.save()
+		}
+	}
+	return fmt.Errorf("key %s not found", id)
+}
+
+// List returns the keys sorted by creation time
+func (s *keyStore) List() ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	keys := append([]*APIKey(nil), s.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// Authorize checks that secret may translate chars characters from source to
+// target within the key's quotas. A request without languages, such as a
+// detection, passes any pair restriction. Nothing is counted until Charge.
+func (s *keyStore) Authorize(secret, source, target string, chars int) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	key := s.find(secret)
+	if key == nil {
+		return nil, &keyError{status: http.StatusForbidden, message: "Invalid API key"}
+	}
+
+	now := time.Now()
+	if key.RevokedAt != nil {
+		return nil, &keyError{status: http.StatusForbidden, message: "API key has been revoked"}
+	}
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, &keyError{status: http.StatusForbidden, message: "API key has expired"}
+	}
+	if (source != "" || target != "") && !key.allowsPair(source, target) {
+		return nil, &keyError{
+			status:  http.StatusForbidden,
+			message: fmt.Sprintf("API key is not allowed to translate %s-%s", source, target),
+		}
+	}
+
+	usage := s.usageLocked(key.ID, now)
+	q := key.Quotas
+	nextMinute := usage.minute.Add(time.Minute).Sub(now)
+	nextDay := usage.day.AddDate(0, 0, 1).Sub(now)
+	switch {
+	case q.RequestsPerMinute > 0 && usage.minuteRequests+1 > q.RequestsPerMinute:
+		return nil, quotaError("requests per minute", nextMinute)
+	case q.CharsPerMinute > 0 && usage.minuteChars+chars > q.CharsPerMinute:
+		return nil, quotaError("characters per minute", nextMinute)
+	case q.RequestsPerDay > 0 && usage.dayRequests+1 > q.RequestsPerDay:
+		return nil, quotaError("requests per day", nextDay)
+	case q.CharsPerDay > 0 && usage.dayChars+chars > q.CharsPerDay:
+		return nil, quotaError("characters per day", nextDay)
+	}
+	return key, nil
+}
+
+// Charge counts a request of chars characters against the quotas of key,
+// once it has been answered successfully
+func (s *keyStore) Charge(key *APIKey, chars int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.usageLocked(key.ID, time.Now())
+	usage.minuteRequests++
+	usage.dayRequests++
+	usage.minuteChars += chars
+	usage.dayChars += chars
+}
+
+// usageLocked returns the usage of the key with id in the windows holding
+// now; s.mu must be held
+func (s *keyStore) usageLocked(id string, now time.Time) *keyUsage {
+	usage := s.usage[id]
+	if usage == nil {
+		usage = &keyUsage{}
+		s.usage[id] = usage
+	}
+	usage.roll(now)
+	return usage
+}
+
+// find returns the key matching secret
+func (s *keyStore) find(secret string) *APIKey {
+	parts := strings.SplitN(secret, "_", 3)
+	if len(parts) != 3 || parts[0] != "lts" {
+		return nil
+	}
+
+	hash := hashKey(secret)
+	for _, key := range s.keys {
+		if key.ID == parts[1] && subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) == 1 {
+			return key
+		}
+	}
+	return nil
+}
+
+// allowsPair reports whether the key may translate from source to target
+func (k *APIKey) allowsPair(source, target string) bool {
+	if len(k.Pairs) == 0 {
+		return true
+	}
+	for _, pair := range k.Pairs {
+		from, to, ok := strings.Cut(pair, "-")
+		if !ok {
+			continue
+		}
+		if (from == "*" || from == source) && (to == "*" || to == target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Status describes whether the key can currently be used
+func (k *APIKey) Status() string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// roll starts new minute and day windows when the current ones have ended
+func (u *keyUsage) roll(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	if !minute.Equal(u.minute) {
+		u.minute = minute
+		u.minuteChars = 0
+		u.minuteRequests = 0
+	}
+
+	y, m, d := now.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	if !day.Equal(u.day) {
+		u.day = day
+		u.dayChars = 0
+		u.dayRequests = 0
+	}
+}
+
+// quotaError reports an exhausted quota that resets after retryAfter
+func quotaError(quota string, retryAfter time.Duration) *keyError {
+	return &keyError{
+		status:     http.StatusTooManyRequests,
+		message:    fmt.Sprintf("API key quota exceeded (%s)", quota),
+		retryAfter: retryAfter,
+	}
+}
+
+// hashKey returns the stored form of a key secret
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// printKeys prints the keys in a table
+func printKeys(keys []*APIKey) {
+	if len(keys) == 0 {
+		color.Yellow("  No API keys yet.\n\n")
+		color.Cyan("💡 To create one, use:\n")
+		color.White("   ./libretranslate-server keys create --label <name>\n")
+		return
+	}
+
+	for _, key := range keys {
+		status := key.Status()
+		switch status {
+		case "active":
+			color.Green("  %s  %s (%s)\n", key.ID, key.Label, status)
+		default:
+			color.Red("  %s  %s (%s)\n", key.ID, key.Label, status)
+		}
+
+		color.White("    Created: %s\n", key.CreatedAt.Format(time.RFC3339))
+		if key.ExpiresAt != nil {
+			color.White("    Expires: %s\n", key.ExpiresAt.Format(time.RFC3339))
+		}
+		if len(key.Pairs) > 0 {
+			color.White("    Pairs:   %s\n", strings.Join(key.Pairs, ", "))
+		}
+
+		q := key.Quotas
+		if q != (KeyQuotas{}) {
+			color.White("    Quotas:  %s\n", formatQuotas(q))
+		}
+	}
+}
+
+// formatQuotas describes the non-zero quotas of a key
+func formatQuotas(q KeyQuotas) string {
+	var parts []string
+	if q.CharsPerMinute > 0 {
+		parts = append(parts, fmt.Sprintf("%d chars/min", q.CharsPerMinute))
+	}
+	if q.CharsPerDay > 0 {
+		parts = append(parts, fmt.Sprintf("%d chars/day", q.CharsPerDay))
+	}
+	if q.RequestsPerMinute > 0 {
+		parts = append(parts, fmt.Sprintf("%d requests/min", q.RequestsPerMinute))
+	}
+	if q.RequestsPerDay > 0 {
+		parts = append(parts, fmt.Sprintf("%d requests/day", q.RequestsPerDay))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// upstreamCall is what LibreTranslate received for a request
+type upstreamCall struct {
+	apiKey, authorization, file string
+}
+
+func TestProxyKeysOnEveryTranslatingRoute(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		calls   []upstreamCall
+		failing atomic.Bool
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := upstreamCall{authorization: r.Header.Get("Authorization")}
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		call.apiKey = r.PostForm.Get("api_key")
+		if file, _, err := r.FormFile("file"); err == nil {
+			data, _ := io.ReadAll(file)
+			call.file = string(data)
+		}
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+
+		if failing.Load() {
+			writeJSONError(w, http.StatusServiceUnavailable, "busy")
+			return
+		}
+		w.Write([]byte(`[{"confidence": 90, "language": "en"}]`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	store, err := loadKeyStore(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := store.Create(APIKey{Label: "test", Quotas: KeyQuotas{RequestsPerMinute: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, srv := newTestProxy(t, upstream.URL, func(cfg *Config) {
+		cfg.Keys.File = keyFile
+		cfg.Keys.Required = true
+		cfg.Keys.UpstreamAPIKey = "upstream-key"
+		cfg.Proxy.Retry.Attempts = 0
+	})
+
+	detect := func(secret string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/detect", strings.NewReader("q=Hello"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := detect(""); status != http.StatusForbidden {
+		t.Fatalf("detection without a key answered %d", status)
+	}
+
+	// A failed call leaves the quota of two requests untouched
+	failing.Store(true)
+	if status := detect(secret); status != http.StatusServiceUnavailable {
+		t.Fatalf("failing detection answered %d", status)
+	}
+	failing.Store(false)
+	if status := detect(secret); status != http.StatusOK {
+		t.Fatalf("detection with a key answered %d", status)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("source", "en")
+	mw.WriteField("target", "es")
+	mw.WriteField("api_key", secret)
+	part, _ := mw.CreateFormFile("file", "subtitles.txt")
+	part.Write([]byte("Hello\nWorld\n"))
+	mw.Close()
+	resp, err := http.Post(srv.URL+"/translate_file", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("file translation with a key answered %d", resp.StatusCode)
+	}
+
+	if status := detect(secret); status != http.StatusTooManyRequests {
+		t.Fatalf("detection over quota answered %d", status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 3 {
+		t.Fatalf("LibreTranslate got %d calls, want 3", len(calls))
+	}
+	for _, call := range calls {
+		if call.apiKey != "upstream-key" || call.authorization != "" {
+			t.Errorf("LibreTranslate got key %q and authorization %q", call.apiKey, call.authorization)
+		}
+	}
+	if calls[2].file != "Hello\nWorld\n" {
+		t.Errorf("LibreTranslate got file %q", calls[2].file)
+	}
+}
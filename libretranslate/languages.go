@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os/exec"
 	"sort"
 	"strings"
@@ -209,8 +210,7 @@ print("SUCCESS")
 		}
 
 		if strings.Contains(line, "ERROR:") {
-			color.Red("❌ %s\n", strings.TrimPrefix(line, "ERROR: "))
-			return fmt.Errorf("language package not found")
+			return fmt.Errorf("language package not found: %s", strings.TrimSpace(strings.TrimPrefix(line, "ERROR: ")))
 		}
 
 		if line == "ALREADY_INSTALLED" {
@@ -269,7 +269,7 @@ func installPopularLanguages() error {
 				skipCount++
 			} else {
 				errorCount++
-				color.Red("  Failed: %v\n", err)
+				slog.Warn("Could not install language package", "pair", lang.name, "error", err)
 			}
 		} else {
 			successCount++
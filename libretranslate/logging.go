@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// logLevel is shared by every log handler so it can be changed at runtime
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel reads debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// setupLogging installs the default logger described by cfg: text or JSON
+// on stderr, and optionally a rotated log file in the same format
+func setupLogging(cfg LoggingConfig) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handlers []slog.Handler
+
+	switch cfg.Format {
+	case "", "text":
+		handlers = append(handlers, newConsoleHandler(color.Error, logLevel))
+	case "json":
+		handlers = append(handlers, slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("invalid log format %q (expected text or json)", cfg.Format)
+	}
+
+	if cfg.File != "" {
+		f, err := newRotatingFile(cfg.File, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+		if cfg.Format == "json" {
+			handlers = append(handlers, slog.NewJSONHandler(f, opts))
+		} else {
+			handlers = append(handlers, slog.NewTextHandler(f, opts))
+		}
+	}
+
+	if len(handlers) == 1 {
+		slog.SetDefault(slog.New(handlers[0]))
+	} else {
+		slog.SetDefault(slog.New(multiHandler(handlers)))
+	}
+	return nil
+}
+
+// consoleHandler writes compact, colored lines for people watching a terminal
+type consoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+	group string
+}
+
+// newConsoleHandler creates a handler writing to w
+func newConsoleHandler(w io.Writer, level slog.Leveler) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("15:04:05"))
+	b.WriteByte(' ')
+	b.WriteString(levelColor(r.Level).Sprintf("%-5s", r.Level.String()))
+	b.WriteByte(' ')
+
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		attrs = append(attrs, a)
+		return true
+	})
+
+	// Output relayed from a child process is shown behind its source
+	for _, a := range attrs {
+		if a.Key == "source" {
+			b.WriteString("[" + a.Value.String() + "] ")
+		}
+	}
+	b.WriteString(r.Message)
+	for _, a := range attrs {
+		if a.Key == "source" || a.Key == "stream" {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%v", a.Key, formatAttrValue(a.Value))
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return &clone
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	if clone.group != "" {
+		name = clone.group + "." + name
+	}
+	clone.group = name
+	return &clone
+}
+
+// levelColor returns the color of a level name on the console
+func levelColor(level slog.Level) *color.Color {
+	switch {
+	case level >= slog.LevelError:
+		return color.New(color.FgRed)
+	case level >= slog.LevelWarn:
+		return color.New(color.FgYellow)
+	case level >= slog.LevelInfo:
+		return color.New(color.FgGreen)
+	default:
+		return color.New(color.FgCyan)
+	}
+}
+
+// formatAttrValue quotes values containing spaces
+func formatAttrValue(v slog.Value) string {
+	s := v.String()
+	if v.Kind() == slog.KindTime {
+		s = v.Time().Format(time.RFC3339)
+	}
+	if strings.ContainsAny(s, " \t\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// multiHandler sends every record to several handlers
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// rotatingFile is a log file that is renamed to path.1, path.2, ... once it
+// grows beyond maxSize, keeping at most maxBackups old files
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// newRotatingFile opens path for appending, creating its directory
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one and starts a new file; r.mu must be held
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+
+	return r.open()
+}
+
+// childLevelPattern finds the level name in lines logged by gunicorn
+// ("[INFO]"), Python's logging module ("INFO:werkzeug:") and similar formats
+var childLevelPattern = regexp.MustCompile(`(?:^|[\[\s|:-])(DEBUG|INFO|WARN|WARNING|ERROR|CRITICAL|FATAL)(?:[\]\s|:-]|$)`)
+
+// exceptionLine matches the last line of a Python traceback
+var exceptionLine = regexp.MustCompile(`^[A-Za-z_][\w.]*(Error|Exception|Exit|Interrupt)\b`)
+
+// childLogParser assigns a severity to each line written by LibreTranslate,
+// whose stderr carries ordinary INFO output as well as real errors
+type childLogParser struct {
+	inTraceback bool
+	last        slog.Level
+}
+
+// Level returns the severity of line
+func (p *childLogParser) Level(line string) slog.Level {
+	if strings.HasPrefix(line, "Traceback (most recent call last)") {
+		p.inTraceback = true
+		p.last = slog.LevelError
+		return p.last
+	}
+
+	if p.inTraceback {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			return slog.LevelError
+		}
+		p.inTraceback = false
+		if exceptionLine.MatchString(line) {
+			return slog.LevelError
+		}
+	}
+
+	head := line
+	if len(head) > 80 {
+		head = head[:80]
+	}
+	if m := childLevelPattern.FindStringSubmatch(head); m != nil {
+		switch m[1] {
+		case "DEBUG":
+			p.last = slog.LevelDebug
+		case "INFO":
+			p.last = slog.LevelInfo
+		case "WARN", "WARNING":
+			p.last = slog.LevelWarn
+		default:
+			p.last = slog.LevelError
+		}
+		return p.last
+	}
+
+	// Indented lines continue the previous message
+	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+		return p.last
+	}
+
+	p.last = slog.LevelInfo
+	return p.last
+}
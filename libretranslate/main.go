@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
@@ -12,7 +15,41 @@ var (
 	version = "1.0.0"
 	port    int
 	host    string
-	verbose bool
+	// startPort is a port number or "auto"
+	startPort string
+	verbose   bool
+	bind      string
+
+	// recordPath and replayPath name a cassette of upstream exchanges
+	recordPath string
+	replayPath string
+	matchMode  string
+
+	configPath string
+	appConfig  Config
+
+	logLevelFlag  string
+	logFormatFlag string
+	logFileFlag   string
+)
+
+// keys command flags
+var (
+	keyLabel   string
+	keyExpires time.Duration
+	keyPairs   []string
+	keyQuotas  KeyQuotas
+)
+
+// fake-server command flags
+var (
+	fakeMode        string
+	fakeTablePath   string
+	fakeLanguages   []string
+	fakeLatency     time.Duration
+	fakeJitter      time.Duration
+	fakeErrorRate   float64
+	fakeErrorStatus int
 )
 
 func main() {
@@ -25,7 +62,30 @@ A Go-based wrapper that manages a local LibreTranslate translation server.
 This tool automatically handles dependencies and provides an easy way to
 run your own translation server for the Dual Subtitles extension.`,
 		Version: version,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(configPath)
+			if err != nil {
+				return err
+			}
+			appConfig = cfg
+
+			// Flags override the logging section of the configuration file
+			if cmd.Flags().Changed("log-level") {
+				appConfig.Logging.Level = logLevelFlag
+			}
+			if cmd.Flags().Changed("log-format") {
+				appConfig.Logging.Format = logFormatFlag
+			}
+			if cmd.Flags().Changed("log-file") {
+				appConfig.Logging.File = logFileFlag
+			}
+			return setupLogging(appConfig.Logging)
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", defaultConfigPath(), "Path to the configuration file")
+	rootCmd.PersistentFlags().StringVar(&logLevelFlag, "log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormatFlag, "log-format", "text", "Log format: text or json")
+	rootCmd.PersistentFlags().StringVar(&logFileFlag, "log-file", "", "Also write logs to this file, rotated by size")
 
 	// Start command
 	startCmd := &cobra.Command{
@@ -34,9 +94,29 @@ run your own translation server for the Dual Subtitles extension.`,
 		Long:  "Start the LibreTranslate server with the specified configuration",
 		Run:   runStart,
 	}
-	startCmd.Flags().IntVarP(&port, "port", "p", 5000, "Port to run the server on")
-	startCmd.Flags().StringVarP(&host, "host", "H", "127.0.0.1", "Host to bind the server to")
-	startCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+
+	// Fake server command
+	fakeServerCmd := &cobra.Command{
+		Use:   "fake-server",
+		Short: "Start a fake LibreTranslate server",
+		Long: `Start an in-process LibreTranslate stand-in with deterministic translations,
+for developing the extension or the proxy without Python or models.
+It takes the flags of start, and its own flags override backend.fake.`,
+		Run: runFakeServer,
+	}
+	fakeServerCmd.Flags().StringVar(&fakeMode, "mode", "prefix", "Translation mode: prefix, reverse or table")
+	fakeServerCmd.Flags().StringVar(&fakeTablePath, "table", "", "JSON file of translations by target code, for the table mode")
+	fakeServerCmd.Flags().StringSliceVar(&fakeLanguages, "languages", nil, "Language codes to offer (default en,es,fr,de)")
+	fakeServerCmd.Flags().DurationVar(&fakeLatency, "latency", 0, "Delay of every translation and detection")
+	fakeServerCmd.Flags().DurationVar(&fakeJitter, "jitter", 0, "Random extra delay of up to this duration")
+	fakeServerCmd.Flags().Float64Var(&fakeErrorRate, "error-rate", 0, "Share of translations and detections that fail, from 0 to 1")
+	fakeServerCmd.Flags().IntVar(&fakeErrorStatus, "error-status", 503, "Status code of the failures")
+
+	for _, cmd := range []*cobra.Command{startCmd, fakeServerCmd} {
+		cmd.Flags().StringVarP(&startPort, "port", "p", strconv.Itoa(defaultServerPort), "Port to run the server on, or auto to pick a free one")
+		cmd.Flags().StringVarP(&host, "host", "H", "127.0.0.1", "Host to bind the server to")
+		cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	}
 
 	// Status command
 	statusCmd := &cobra.Command{
@@ -45,13 +125,13 @@ run your own translation server for the Dual Subtitles extension.`,
 		Long:  "Check if the LibreTranslate server is running",
 		Run:   runStatus,
 	}
-	statusCmd.Flags().IntVarP(&port, "port", "p", 5000, "Port to check")
+	statusCmd.Flags().IntVarP(&port, "port", "p", 0, "Port to check (default the port of the last started server)")
 
 	// Install command
 	installCmd := &cobra.Command{
 		Use:   "install",
 		Short: "Install LibreTranslate dependencies",
-		Long:  "Install Python and LibreTranslate if not already installed",
+		Long:  "Install Python and LibreTranslate, or pull the container image, depending on the configured backend",
 		Run:   runInstall,
 	}
 
@@ -62,7 +142,7 @@ run your own translation server for the Dual Subtitles extension.`,
 		Long:  "Stop a running LibreTranslate server",
 		Run:   runStop,
 	}
-	stopCmd.Flags().IntVarP(&port, "port", "p", 5000, "Port of the server to stop")
+	stopCmd.Flags().IntVarP(&port, "port", "p", 0, "Port of the server to stop (default the port of the last started server)")
 
 	// Web command
 	webCmd := &cobra.Command{
@@ -72,6 +152,11 @@ run your own translation server for the Dual Subtitles extension.`,
 		Run:   runWeb,
 	}
 	webCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port for web interface")
+	webCmd.Flags().StringVar(&bind, "bind", "", "Address to bind the web interface to (default from config, 127.0.0.1)")
+	webCmd.Flags().StringVar(&recordPath, "record", "", "Record the exchanges with LibreTranslate to this cassette file")
+	webCmd.Flags().StringVar(&replayPath, "replay", "", "Answer from this cassette file instead of LibreTranslate")
+	webCmd.Flags().StringVar(&matchMode, "match", "", "Matching of replayed requests: strict or lenient (default from config, strict)")
+	webCmd.MarkFlagsMutuallyExclusive("record", "replay")
 
 	// Languages command
 	languagesCmd := &cobra.Command{
@@ -110,7 +195,59 @@ run your own translation server for the Dual Subtitles extension.`,
 
 	languagesCmd.AddCommand(langListCmd, langInstalledCmd, langInstallCmd, langPopularCmd)
 
-	rootCmd.AddCommand(startCmd, statusCmd, installCmd, stopCmd, webCmd, languagesCmd)
+	// CORS command
+	corsCmd := &cobra.Command{
+		Use:   "cors",
+		Short: "Inspect the CORS policy of the web proxy",
+	}
+
+	corsTestCmd := &cobra.Command{
+		Use:   "test <origin>",
+		Short: "Show what an origin is allowed to do",
+		Long:  "Show whether an origin (e.g. 'chrome-extension://<id>') may call the proxy, and with which methods and headers",
+		Args:  cobra.ExactArgs(1),
+		Run:   runCORSTest,
+	}
+
+	corsCmd.AddCommand(corsTestCmd)
+
+	// Keys command
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage API keys for the translation proxy",
+	}
+
+	keysCreateCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create an API key",
+		Long:  "Create an API key. The key is shown once; only its hash is stored.",
+		Run:   runKeysCreate,
+	}
+	keysCreateCmd.Flags().StringVarP(&keyLabel, "label", "l", "", "Label describing who uses the key")
+	keysCreateCmd.Flags().DurationVar(&keyExpires, "expires", 0, "Lifetime of the key, e.g. 720h (default never expires)")
+	keysCreateCmd.Flags().StringSliceVar(&keyPairs, "pairs", nil, "Allowed language pairs, e.g. en-es,en-* (default all)")
+	keysCreateCmd.Flags().IntVar(&keyQuotas.CharsPerMinute, "chars-per-minute", 0, "Characters allowed per minute")
+	keysCreateCmd.Flags().IntVar(&keyQuotas.CharsPerDay, "chars-per-day", 0, "Characters allowed per day")
+	keysCreateCmd.Flags().IntVar(&keyQuotas.RequestsPerMinute, "requests-per-minute", 0, "Requests allowed per minute")
+	keysCreateCmd.Flags().IntVar(&keyQuotas.RequestsPerDay, "requests-per-day", 0, "Requests allowed per day")
+	keysCreateCmd.MarkFlagRequired("label")
+
+	keysListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List API keys",
+		Run:   runKeysList,
+	}
+
+	keysRevokeCmd := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an API key",
+		Args:  cobra.ExactArgs(1),
+		Run:   runKeysRevoke,
+	}
+
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+
+	rootCmd.AddCommand(startCmd, fakeServerCmd, statusCmd, installCmd, stopCmd, webCmd, languagesCmd, corsCmd, keysCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -119,63 +256,132 @@ run your own translation server for the Dual Subtitles extension.`,
 }
 
 func runStart(cmd *cobra.Command, args []string) {
-	color.Cyan("🚀 Starting LibreTranslate Server Manager v%s\n", version)
+	slog.Info("Starting LibreTranslate Server Manager", "version", version)
+
+	port, err := parsePort(startPort)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: host, Port: port, Verbose: verbose})
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 
 	// Check dependencies
-	if err := checkDependencies(); err != nil {
-		color.Red("❌ Dependencies not met: %v\n", err)
+	if err := b.Check(); err != nil {
+		slog.Error("Dependencies not met", "error", err)
 		color.Yellow("💡 Run 'libretranslate-server install' to install dependencies\n")
 		os.Exit(1)
 	}
 
 	// Start server
 	if err := startServer(host, port, verbose); err != nil {
-		color.Red("❌ Failed to start server: %v\n", err)
+		slog.Error("Failed to start server", "error", err)
 		os.Exit(1)
 	}
 }
 
+// runFakeServer starts the fake backend, whatever backend is configured
+func runFakeServer(cmd *cobra.Command, args []string) {
+	appConfig.Backend.Type = "fake"
+	fake := &appConfig.Backend.Fake
+	if cmd.Flags().Changed("mode") {
+		fake.Mode = fakeMode
+	}
+	if cmd.Flags().Changed("table") {
+		fake.Table = fakeTablePath
+		if !cmd.Flags().Changed("mode") {
+			fake.Mode = fakeTable
+		}
+	}
+	if cmd.Flags().Changed("languages") {
+		fake.Languages = fakeLanguages
+	}
+	if cmd.Flags().Changed("latency") {
+		fake.Latency = Duration(fakeLatency)
+	}
+	if cmd.Flags().Changed("jitter") {
+		fake.Jitter = Duration(fakeJitter)
+	}
+	if cmd.Flags().Changed("error-rate") {
+		fake.ErrorRate = fakeErrorRate
+	}
+	if cmd.Flags().Changed("error-status") {
+		fake.ErrorStatus = fakeErrorStatus
+	}
+	runStart(cmd, args)
+}
+
 func runStatus(cmd *cobra.Command, args []string) {
-	color.Cyan("🔍 Checking server status...\n")
+	if !cmd.Flags().Changed("port") {
+		port = serverPort()
+	}
+	slog.Info("Checking server status")
 	checkStatus(port)
 }
 
 func runInstall(cmd *cobra.Command, args []string) {
-	color.Cyan("📦 Installing LibreTranslate dependencies...\n")
-	if err := installDependencies(); err != nil {
-		color.Red("❌ Installation failed: %v\n", err)
+	slog.Info("Installing LibreTranslate dependencies")
+
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: host, Port: port})
+	if err != nil {
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
-	color.Green("✅ Installation complete!\n")
+
+	if err := b.Install(); err != nil {
+		slog.Error("Installation failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Installation complete")
 }
 
 func runStop(cmd *cobra.Command, args []string) {
-	color.Cyan("🛑 Stopping LibreTranslate server...\n")
+	if !cmd.Flags().Changed("port") {
+		port = serverPort()
+	}
+	slog.Info("Stopping LibreTranslate server", "port", port)
 	if err := stopServer(port); err != nil {
-		color.Red("❌ Failed to stop server: %v\n", err)
+		slog.Error("Failed to stop server", "error", err)
 		os.Exit(1)
 	}
-	color.Green("✅ Server stopped\n")
+	slog.Info("Server stopped")
 }
 
 func runWeb(cmd *cobra.Command, args []string) {
-	color.Cyan("🌐 Starting web management interface on port %d...\n", port)
-	if err := startWebInterface(port); err != nil {
-		color.Red("❌ Failed to start web interface: %v\n", err)
+	if bind == "" {
+		bind = appConfig.Web.Bind
+	}
+	if recordPath != "" {
+		appConfig.Cassette.Mode, appConfig.Cassette.File = cassetteRecord, recordPath
+	}
+	if replayPath != "" {
+		appConfig.Cassette.Mode, appConfig.Cassette.File = cassetteReplay, replayPath
+	}
+	if matchMode != "" {
+		appConfig.Cassette.Match = matchMode
+	}
+
+	slog.Info("Starting web management interface", "port", port)
+	if err := startWebInterface(bind, port); err != nil {
+		slog.Error("Failed to start web interface", "error", err)
 		os.Exit(1)
 	}
 }
 
 func runLanguagesList(cmd *cobra.Command, args []string) {
 	if err := listAvailableLanguages(); err != nil {
-		color.Red("❌ Failed to list languages: %v\n", err)
+		slog.Error("Failed to list languages", "error", err)
 		os.Exit(1)
 	}
 }
 
 func runLanguagesInstalled(cmd *cobra.Command, args []string) {
 	if err := listInstalledLanguages(); err != nil {
-		color.Red("❌ Failed to list installed languages: %v\n", err)
+		slog.Error("Failed to list installed languages", "error", err)
 		os.Exit(1)
 	}
 }
@@ -185,14 +391,75 @@ func runLanguagesInstall(cmd *cobra.Command, args []string) {
 	toCode := args[1]
 
 	if err := installLanguage(fromCode, toCode); err != nil {
-		color.Red("❌ Failed to install language: %v\n", err)
+		slog.Error("Failed to install language", "from", fromCode, "to", toCode, "error", err)
 		os.Exit(1)
 	}
 }
 
 func runLanguagesPopular(cmd *cobra.Command, args []string) {
 	if err := installPopularLanguages(); err != nil {
-		color.Red("❌ Failed to install popular languages: %v\n", err)
+		slog.Error("Failed to install popular languages", "error", err)
+		os.Exit(1)
+	}
+}
+
+func runCORSTest(cmd *cobra.Command, args []string) {
+	printCORSDecision(newCORSPolicy(appConfig.CORS).Check(args[0]))
+}
+
+// The key commands answer on stdout, errors included, rather than through
+// the log: the secret of a new key must not end up in a log file.
+func runKeysCreate(cmd *cobra.Command, args []string) {
+	store, err := loadKeyStore(appConfig.Keys.File)
+	if err != nil {
+		color.Red("❌ %v\n", err)
+		os.Exit(1)
+	}
+
+	key := APIKey{Label: keyLabel, Pairs: keyPairs, Quotas: keyQuotas}
+	if keyExpires > 0 {
+		expires := time.Now().Add(keyExpires)
+		key.ExpiresAt = &expires
+	}
+
+	secret, created, err := store.Create(key)
+	if err != nil {
+		color.Red("❌ Failed to create key: %v\n", err)
+		os.Exit(1)
+	}
+
+	color.Green("✅ Created key %s (%s)\n\n", created.ID, created.Label)
+	color.White("   %s\n\n", secret)
+	color.Yellow("💡 Store this key now, it cannot be shown again\n")
+}
+
+func runKeysList(cmd *cobra.Command, args []string) {
+	store, err := loadKeyStore(appConfig.Keys.File)
+	if err != nil {
+		color.Red("❌ %v\n", err)
+		os.Exit(1)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		color.Red("❌ Failed to list keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	color.Cyan("🔑 API keys:\n\n")
+	printKeys(keys)
+}
+
+func runKeysRevoke(cmd *cobra.Command, args []string) {
+	store, err := loadKeyStore(appConfig.Keys.File)
+	if err != nil {
+		color.Red("❌ %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := store.Revoke(args[0]); err != nil {
+		color.Red("❌ Failed to revoke key: %v\n", err)
 		os.Exit(1)
 	}
+	color.Green("✅ Key %s revoked\n", args[0])
 }
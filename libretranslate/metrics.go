@@ -0,0 +1,524 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPairLabels bounds the number of distinct language pairs in metrics;
+// further pairs are reported as "other"
+const maxPairLabels = 100
+
+// metricsRegistry holds metrics and renders them in the Prometheus text format
+type metricsRegistry struct {
+	mu         sync.Mutex
+	families   []*metricFamily
+	collectors []func()
+}
+
+// metricFamily is a named metric with a fixed set of labels
+type metricFamily struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// metricSeries is one combination of label values
+type metricSeries struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newMetricsRegistry creates an empty registry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+// Counter registers a counter
+func (m *metricsRegistry) Counter(name, help string, labels ...string) *metricFamily {
+	return m.register(&metricFamily{name: name, help: help, kind: "counter", labels: labels})
+}
+
+// Gauge registers a gauge
+func (m *metricsRegistry) Gauge(name, help string, labels ...string) *metricFamily {
+	return m.register(&metricFamily{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+// Histogram registers a histogram with the given upper bounds
+func (m *metricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return m.register(&metricFamily{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// OnCollect registers fn to refresh gauges right before each scrape
+func (m *metricsRegistry) OnCollect(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+func (m *metricsRegistry) register(f *metricFamily) *metricFamily {
+	f.series = make(map[string]*metricSeries)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.families = append(m.families, f)
+	return f
+}
+
+// get returns the series for values, creating it when needed; f.mu must be held
+func (f *metricFamily) get(values []string) *metricSeries {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s := f.series[key]
+	if s == nil {
+		s = &metricSeries{values: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Add increases a counter or gauge
+func (f *metricFamily) Add(v float64, values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(values).value += v
+}
+
+// Inc increases a counter or gauge by one
+func (f *metricFamily) Inc(values ...string) {
+	f.Add(1, values...)
+}
+
+// Set sets a gauge
+func (f *metricFamily) Set(v float64, values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(values).value = v
+}
+
+// Reset removes every series, for gauges whose label sets change over time
+func (f *metricFamily) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.series = make(map[string]*metricSeries)
+}
+
+// Observe records a histogram sample
+func (f *metricFamily) Observe(v float64, values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.get(values)
+	for i, upper := range f.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// WriteText renders every metric in the Prometheus text exposition format
+func (m *metricsRegistry) WriteText(w io.Writer) {
+	m.mu.Lock()
+	collectors := append([]func(){}, m.collectors...)
+	families := append([]*metricFamily(nil), m.families...)
+	m.mu.Unlock()
+
+	for _, collect := range collectors {
+		collect()
+	}
+
+	for _, f := range families {
+		f.writeText(w)
+	}
+}
+
+func (f *metricFamily) writeText(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, upper := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.values, "", ""), s.count)
+	}
+}
+
+// labelEscaper escapes a label value the way the text format expects, which
+// unlike %q leaves every other character as it is
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {name="value",...}, appending an extra label if set
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatFloat renders a sample value
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// languageCode matches the language codes LibreTranslate uses
+var languageCode = regexp.MustCompile(`^([a-z]{2,3}(-[A-Za-z]{2,4})?|auto)$`)
+
+// labelLimiter keeps the set of values of a label bounded
+type labelLimiter struct {
+	mu     sync.Mutex
+	max    int
+	values map[string]bool
+}
+
+// newLabelLimiter allows at most max distinct values
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{max: max, values: make(map[string]bool)}
+}
+
+// Value returns v when it is already known or there is room for it, and
+// "other" once the limit is reached
+func (l *labelLimiter) Value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.values[v] {
+		return v
+	}
+	if len(l.values) >= l.max {
+		return "other"
+	}
+	l.values[v] = true
+	return v
+}
+
+// proxyRoutes are the route label values; other paths count as "other"
+var proxyRoutes = []string{
+	"/translate", "/translate_file", "/detect", "/languages", "/suggest",
+	"/frontend/settings", "/scheduler/seek",
+}
+
+// routeLabel maps a request path to a bounded route label
+func routeLabel(path string) string {
+	for _, route := range proxyRoutes {
+		if path == route {
+			return route
+		}
+	}
+	return "other"
+}
+
+// proxyMetrics are the metrics recorded by the web interface and proxy
+type proxyMetrics struct {
+	registry *metricsRegistry
+	pairs    *labelLimiter
+
+	requests         *metricFamily
+	duration         *metricFamily
+	upstreamRequests *metricFamily
+	upstreamErrors   *metricFamily
+}
+
+// durationBuckets are the latency histogram bounds, in seconds
+var durationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// newProxyMetrics registers the proxy metrics
+func newProxyMetrics() *proxyMetrics {
+	r := newMetricsRegistry()
+	return &proxyMetrics{
+		registry: r,
+		pairs:    newLabelLimiter(maxPairLabels),
+		requests: r.Counter("lts_proxy_requests_total",
+			"Requests handled by the proxy.", "route", "pair", "code"),
+		duration: r.Histogram("lts_proxy_request_duration_seconds",
+			"Time to answer proxied requests.", durationBuckets, "route", "pair", "code"),
+		upstreamRequests: r.Counter("lts_upstream_requests_total",
+			"Requests sent to LibreTranslate.", "route"),
+		upstreamErrors: r.Counter("lts_upstream_errors_total",
+			"Failed requests to LibreTranslate, by kind (connect, timeout, cancelled, no_upstream, circuit_open, cassette_miss, status_5xx).", "route", "kind"),
+	}
+}
+
+// pairLabel returns a bounded label for a language pair
+func (m *proxyMetrics) pairLabel(source, target string) string {
+	if !languageCode.MatchString(source) || !languageCode.MatchString(target) {
+		return "other"
+	}
+	return m.pairs.Value(source + "-" + target)
+}
+
+// requestInfoKey is the context key of a *requestInfo
+type requestInfoKey struct{}
+
+// requestInfo collects what handlers learn about a request for metrics
+type requestInfo struct {
+	pair string
+	// aborted is set when the connection was dropped without an answer
+	aborted bool
+}
+
+// statusNoResponse is recorded for requests whose connection was dropped
+// without an answer, as nginx logs them
+const statusNoResponse = 444
+
+// infoFrom returns the requestInfo attached to r, if any
+func infoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// statusRecorder remembers the status written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Status returns the status written so far, defaulting to 200
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// Flush keeps streamed responses flowing through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// observe records a finished request
+func (m *proxyMetrics) observe(path, pair string, status int, elapsed time.Duration) {
+	labels := []string{routeLabel(path), pair, strconv.Itoa(status)}
+	m.requests.Inc(labels...)
+	m.duration.Observe(elapsed.Seconds(), labels...)
+}
+
+// watchProxy exports the scheduler and coalescing statistics of p
+func (m *proxyMetrics) watchProxy(p *libreTranslateProxy) {
+	r := m.registry
+	queueDepth := r.Gauge("lts_scheduler_queue_depth",
+		"Requests waiting for an upstream slot, by priority.", "priority")
+	active := r.Gauge("lts_scheduler_active",
+		"Requests currently sent to LibreTranslate.")
+	outcomes := r.Counter("lts_scheduler_outcomes_total",
+		"Requests by scheduler outcome.", "outcome")
+	coalesced := r.Counter("lts_coalesce_requests_total",
+		"Translation requests seen by the coalescer, by whether they shared another call.", "shared")
+	hitRatio := r.Gauge("lts_coalesce_hit_ratio",
+		"Fraction of translation requests answered by another request's upstream call.")
+	healthy := r.Gauge("lts_upstream_healthy",
+		"Whether a server of the pool is taking requests, by upstream.", "upstream")
+	outstanding := r.Gauge("lts_upstream_outstanding",
+		"Requests in flight to a server of the pool, by upstream.", "upstream")
+	ejections := r.Counter("lts_upstream_ejections_total",
+		"Times a server was taken out of rotation after failing, by upstream.", "upstream")
+	replicas := r.Gauge("lts_pool_replicas",
+		"Local replicas run next to the managed server.")
+	circuit := r.Gauge("lts_upstream_circuit_state",
+		"Circuit breaker state of a server of the pool: 0 closed, 1 half open, 2 open.", "upstream")
+	trips := r.Counter("lts_upstream_circuit_trips_total",
+		"Times the circuit of a server was opened, by upstream.", "upstream")
+	retries := r.Counter("lts_upstream_retries_total",
+		"Upstream requests sent again after a failure.")
+
+	r.OnCollect(func() {
+		stats := p.sched.Stats()
+		queueDepth.Reset()
+		for _, name := range []string{"prefetch", "normal", "onscreen"} {
+			queueDepth.Set(0, name)
+		}
+		for priority, n := range stats.WaitingBy {
+			queueDepth.Set(float64(n), priorityLabel(priority))
+		}
+		active.Set(float64(stats.Active))
+		outcomes.Set(float64(stats.Served), "served")
+		outcomes.Set(float64(stats.Rejected), "rejected")
+		outcomes.Set(float64(stats.Expired), "expired")
+		outcomes.Set(float64(stats.SeekDropped), "seek_dropped")
+
+		flights := p.flights.Stats()
+		coalesced.Set(float64(flights.Requests-flights.Shared), "false")
+		coalesced.Set(float64(flights.Shared), "true")
+		hitRatio.Set(flights.HitRate)
+
+		pool := p.pool.Stats()
+		for _, f := range []*metricFamily{healthy, outstanding, ejections, circuit, trips} {
+			f.Reset()
+		}
+		for _, m := range pool.Members {
+			healthy.Set(boolValue(m.Healthy), m.Name)
+			outstanding.Set(float64(m.Outstanding), m.Name)
+			ejections.Set(float64(m.Ejections), m.Name)
+			circuit.Set(circuitValue(m.Circuit), m.Name)
+			trips.Set(float64(m.Trips), m.Name)
+		}
+		replicas.Set(float64(pool.Replicas))
+		retries.Set(float64(pool.Retries))
+	})
+}
+
+// boolValue exports a condition as 1 or 0
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// priorityLabel names a scheduler priority, bounding custom values
+func priorityLabel(priority int) string {
+	switch {
+	case priority <= priorityPrefetch:
+		return "prefetch"
+	case priority == priorityNormal:
+		return "normal"
+	default:
+		return "onscreen"
+	}
+}
+
+// watchServer exports the state of the LibreTranslate server started by
+// this tool, read from the instance file at each scrape
+func (m *proxyMetrics) watchServer() {
+	r := m.registry
+	up := r.Gauge("lts_server_up",
+		"Whether LibreTranslate answers health checks.")
+	starts := r.Gauge("lts_server_starts",
+		"Times the server has been started by this tool; increases on restarts.")
+	loadTime := r.Gauge("lts_server_model_load_seconds",
+		"Time the last start took until the server was ready.")
+	rss := r.Gauge("lts_server_resident_memory_bytes",
+		"Resident memory of the LibreTranslate process group.")
+	cpu := r.Counter("lts_server_cpu_seconds_total",
+		"CPU time used by the LibreTranslate process group.")
+	threads := r.Gauge("lts_server_threads",
+		"Threads of the LibreTranslate process group.")
+	memoryLimit := r.Gauge("lts_server_memory_limit_bytes",
+		"Memory limit applied to the server; absent without a limit.")
+	cpuLimit := r.Gauge("lts_server_cpu_limit_cores",
+		"CPU limit applied to the server, in cores; absent without a limit.")
+	nearLimit := r.Gauge("lts_server_near_limit",
+		"Whether usage is above the warning share of a limit, by resource.", "resource")
+	sampler := &usageSampler{}
+
+	r.OnCollect(func() {
+		state, err := loadInstanceState()
+		if err != nil {
+			return
+		}
+		// A suspended server would only time out the health check
+		running := !state.Suspended && isServerRunning(serverPort())
+		up.Set(boolValue(running))
+		starts.Set(float64(state.Starts))
+		loadTime.Set(state.LoadTime().Seconds())
+
+		for _, f := range []*metricFamily{rss, cpu, threads, memoryLimit, cpuLimit, nearLimit} {
+			f.Reset()
+		}
+		if l := state.Limits; l != nil {
+			if l.MemoryBytes > 0 {
+				memoryLimit.Set(float64(l.MemoryBytes))
+			}
+			if l.CPUs > 0 {
+				cpuLimit.Set(l.CPUs)
+			}
+		}
+		if !running || state.PID == 0 {
+			return
+		}
+		usage, err := sampler.Sample(state.PID, state.Limits)
+		if err != nil {
+			return
+		}
+		rss.Set(float64(usage.RSSBytes))
+		cpu.Set(usage.CPUSeconds)
+		threads.Set(float64(usage.Threads))
+		if state.Limits != nil {
+			nearMemory, nearCPU := state.Limits.nearLimits(usage)
+			nearLimit.Set(boolValue(nearMemory), "memory")
+			nearLimit.Set(boolValue(nearCPU), "cpu")
+		}
+	})
+}
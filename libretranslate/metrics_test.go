@@ -0,0 +1,11 @@
+package main
+
+import "testing"
+
+func TestFormatLabelsEscaping(t *testing.T) {
+	got := formatLabels([]string{"path", "lang"}, []string{"C:\\tmp \"x\"\nnext", "español\t"}, "le", "+Inf")
+	want := `{path="C:\\tmp \"x\"\nnext",lang="español` + "\t" + `",le="+Inf"}`
+	if got != want {
+		t.Fatalf("formatLabels rendered %s, want %s", got, want)
+	}
+}
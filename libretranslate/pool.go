@@ -0,0 +1,795 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoUpstream is returned when the pool has no server to send a request to
+var errNoUpstream = errors.New("no LibreTranslate server available")
+
+// Kinds of pool members
+const (
+	// memberServer is the server managed by start, stop and the idle policy
+	memberServer   = "server"
+	memberExternal = "external"
+	memberReplica  = "replica"
+	memberShard    = "shard"
+)
+
+// shardRestartDelay is how long a shard that exited waits to be restarted
+const shardRestartDelay = 5 * time.Second
+
+// upstreamMember is one LibreTranslate server of the pool. Its mutable
+// fields are guarded by the pool's mutex.
+type upstreamMember struct {
+	name string
+	kind string
+	url  *url.URL
+	// backend runs a replica or shard; it is nil for other members
+	backend Backend
+	// languages are the codes a shard loads; other members hold every one
+	languages []string
+
+	healthy     bool
+	starting    bool
+	started     bool
+	draining    bool
+	outstanding int
+	fails       int
+	passes      int
+	served      int64
+	ejections   int64
+	lastError   string
+	// breaker stops requests to the member after consecutive failures
+	breaker circuitBreaker
+}
+
+// upstreamPool sends each request to the healthy member with the fewest
+// requests in flight, and to another member when a server cannot be reached.
+// Health checks eject failing members and admit them again once they
+// recover. Local replicas are added when requests queue up and removed once
+// the other servers have had spare capacity for a while. Failed requests
+// are retried, and a server that keeps failing them has its circuit opened.
+type upstreamPool struct {
+	cfg           PoolConfig
+	shards        []ShardConfig
+	backend       BackendConfig
+	warmup        WarmupConfig
+	retry         RetryConfig
+	breaker       BreakerConfig
+	maxConcurrent int
+	sched         *upstreamScheduler
+
+	mu       sync.Mutex
+	members  []*upstreamMember
+	rotation int
+	// replicaSeq numbers replicas for their names
+	replicaSeq int
+	busyAt     time.Time
+	closed     bool
+	retries    int64
+
+	// done stops the health checks once Close is called
+	done      chan struct{}
+	closeOnce sync.Once
+	// removeHook unregisters Close from the shutdown hooks
+	removeHook func()
+}
+
+// poolMemberStats describes a member in the status API
+type poolMemberStats struct {
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	URL         string   `json:"url"`
+	Languages   []string `json:"languages,omitempty"`
+	Healthy     bool     `json:"healthy"`
+	Starting    bool     `json:"starting,omitempty"`
+	Draining    bool     `json:"draining,omitempty"`
+	Outstanding int      `json:"outstanding"`
+	Served      int64    `json:"served"`
+	Ejections   int64    `json:"ejections"`
+	LastError   string   `json:"last_error,omitempty"`
+	Circuit     string   `json:"circuit"`
+	Trips       int64    `json:"circuit_trips"`
+}
+
+// poolStats is a snapshot of the pool exposed through the status API
+type poolStats struct {
+	Members     []poolMemberStats `json:"members"`
+	Healthy     int               `json:"healthy"`
+	Replicas    int               `json:"replicas"`
+	Shards      int               `json:"shards"`
+	Retries     int64             `json:"retries"`
+	MinReplicas int               `json:"min_replicas"`
+	MaxReplicas int               `json:"max_replicas"`
+}
+
+// newUpstreamPool creates a pool of the server at primary and the servers
+// configured in cfg, starting the shards and the minimum number of
+// replicas. Shards take the place of the server at primary.
+func newUpstreamPool(cfg Config, primary string, sched *upstreamScheduler) (*upstreamPool, error) {
+	p := &upstreamPool{
+		cfg:           cfg.Pool,
+		shards:        cfg.Shards,
+		backend:       cfg.Backend,
+		warmup:        cfg.Warmup,
+		retry:         cfg.Proxy.Retry,
+		breaker:       cfg.Proxy.Breaker,
+		maxConcurrent: cfg.Limits.MaxConcurrent,
+		sched:         sched,
+		busyAt:        time.Now(),
+		done:          make(chan struct{}),
+	}
+	if err := p.cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	local := cfg.Backend.Type == "" || cfg.Backend.Type == "native" || cfg.Backend.Type == "fake"
+	if len(p.shards) > 0 {
+		if !local {
+			return nil, fmt.Errorf("shards need the native backend, not %q", cfg.Backend.Type)
+		}
+		if err := checkShards(p.shards); err != nil {
+			return nil, err
+		}
+		if p.cfg.MaxReplicas > 0 {
+			slog.Warn("Replicas ignored: shards are not replicated")
+			p.cfg.MinReplicas, p.cfg.MaxReplicas = 0, 0
+		}
+	}
+	if p.cfg.MaxReplicas > 0 && !local {
+		slog.Warn("Replicas ignored: only the native backend can run several servers", "backend", cfg.Backend.Type)
+		p.cfg.MinReplicas, p.cfg.MaxReplicas = 0, 0
+	}
+	if p.cfg.MaxReplicas < p.cfg.MinReplicas {
+		p.cfg.MaxReplicas = p.cfg.MinReplicas
+	}
+
+	if len(p.shards) == 0 {
+		primaryURL, err := parseUpstreamURL(primary)
+		if err != nil {
+			return nil, err
+		}
+		p.members = append(p.members, &upstreamMember{name: memberServer, kind: memberServer, url: primaryURL, healthy: true})
+	}
+	for _, raw := range cfg.Pool.URLs {
+		u, err := parseUpstreamURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.members = append(p.members, &upstreamMember{name: u.Host, kind: memberExternal, url: u, healthy: true})
+	}
+
+	p.mu.Lock()
+	p.updateCapacityLocked()
+	for _, shard := range p.shards {
+		p.startLocalLocked(memberShard, shard.Name, shard.LoadOnly)
+	}
+	for i := 0; i < p.cfg.MinReplicas; i++ {
+		p.addReplicaLocked()
+	}
+	p.mu.Unlock()
+
+	if p.cfg.MaxReplicas > 0 || len(p.shards) > 0 {
+		p.removeHook = onShutdown(p.Close)
+	}
+	go p.run()
+	return p, nil
+}
+
+// Close stops the health checks, and the replicas and shards
+func (p *upstreamPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		if p.removeHook != nil {
+			p.removeHook()
+		}
+		p.stopLocal()
+	})
+}
+
+// parseUpstreamURL checks the base URL of a LibreTranslate server
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid upstream url %q", raw)
+	}
+	return u, nil
+}
+
+// SetPrimary points the managed server's member at target, which moves
+// with the server's port. A new address starts with a clean health record.
+func (p *upstreamPool) SetPrimary(target string) error {
+	u, err := parseUpstreamURL(target)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, old := range p.members {
+		if old.kind != memberServer || old.url.String() == u.String() {
+			continue
+		}
+		p.members[i] = &upstreamMember{name: memberServer, kind: memberServer, url: u, healthy: true}
+		p.updateCapacityLocked()
+		slog.Info("Proxy target changed", "from", old.url.String(), "to", u.String())
+	}
+	return nil
+}
+
+// RoundTrip sends req to the pool, retrying it with backoff when it is safe
+// to send again and the server could not answer it. Retries go to a healthy
+// member not tried yet, and to the same ones again once none is left.
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 0
+	if p.retry.retryable(req) {
+		attempts = p.retry.Attempts
+	}
+	pair := pairFrom(req.Context())
+	tried := make(map[*upstreamMember]bool)
+	for attempt := 0; ; attempt++ {
+		resp, err := p.send(req, attempt > 0, tried)
+		var open *errCircuitOpen
+		if attempt >= attempts || !worthRetrying(resp, err) || errors.Is(err, errNoUpstream) ||
+			errors.As(err, &open) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if !p.hasUntried(tried, pair) {
+			clear(tried)
+		}
+
+		var failure string
+		if err != nil {
+			failure = err.Error()
+		} else {
+			failure = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		delay := p.retry.backoff(attempt)
+		p.mu.Lock()
+		p.retries++
+		p.mu.Unlock()
+		slog.Debug("Retrying upstream request", "path", req.URL.Path, "retry", attempt+1, "delay", delay, "failure", failure)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// send sends req to a member of the pool holding its language pair and not
+// in tried, trying the others in turn when a server refuses the connection.
+// rewind replays a body consumed by an earlier attempt.
+func (p *upstreamPool) send(req *http.Request, rewind bool, tried map[*upstreamMember]bool) (*http.Response, error) {
+	pair := pairFrom(req.Context())
+	headerTimeout := timeoutsFrom(req.Context()).Header
+	var lastErr error = errNoUpstream
+	for {
+		m, blocked := p.pick(tried, pair)
+		if m == nil {
+			if lastErr == errNoUpstream && blocked > 0 {
+				return nil, &errCircuitOpen{retryAfter: blocked}
+			}
+			return nil, lastErr
+		}
+
+		ctx, cancel := context.WithCancelCause(req.Context())
+		out := req.Clone(ctx)
+		out.URL.Scheme = m.url.Scheme
+		out.URL.Host = m.url.Host
+		out.URL.Path = strings.TrimSuffix(m.url.Path, "/") + req.URL.Path
+		out.URL.RawPath = ""
+		out.Host = ""
+		if (rewind || len(tried) > 0) && req.Body != nil && req.Body != http.NoBody {
+			// The failed attempt consumed the body
+			var body io.ReadCloser
+			err := errors.New("request body cannot be replayed")
+			if req.GetBody != nil {
+				body, err = req.GetBody()
+			}
+			if err != nil {
+				cancel(nil)
+				p.settle(m, nil, context.Canceled)
+				p.release(m, nil)
+				return nil, lastErr
+			}
+			out.Body = body
+		}
+		tried[m] = true
+
+		var timer *time.Timer
+		if headerTimeout > 0 {
+			timer = time.AfterFunc(headerTimeout, func() { cancel(errHeaderTimeout) })
+		}
+		resp, err := upstreamTransport.RoundTrip(out)
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			if context.Cause(ctx) == errHeaderTimeout {
+				err = errHeaderTimeout
+			}
+			cancel(nil)
+			p.settle(m, nil, err)
+
+			if !isDialError(err) {
+				p.release(m, nil)
+				return nil, err
+			}
+			p.release(m, err)
+			lastErr = err
+			slog.Debug("Upstream unreachable, trying another server", "upstream", m.name, "error", err)
+			continue
+		}
+
+		p.settle(m, resp, nil)
+		resp.Body = &memberBody{ReadCloser: resp.Body, release: func() {
+			cancel(nil)
+			p.release(m, nil)
+		}}
+		return resp, nil
+	}
+}
+
+// memberBody frees the member's slot once the response has been read
+type memberBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *memberBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// hasUntried reports whether a healthy member holding pair that is not in
+// tried could take a request now
+func (p *upstreamPool) hasUntried(tried map[*upstreamMember]bool, pair *languagePair) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range p.members {
+		if !tried[m] && m.healthy && !m.draining && !m.starting && m.holds(pair) && m.breaker.ready(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick takes the healthy member with the fewest requests in flight, among
+// those holding pair, if any, and not tried yet. When none is healthy, the
+// unhealthy ones are tried anyway rather than failing every request, except
+// servers still starting. Members with an open circuit are never picked;
+// when they are all that is left, blocked is the time until one of them
+// lets a trial request through.
+func (p *upstreamPool) pick(tried map[*upstreamMember]bool, pair *languagePair) (best *upstreamMember, blocked time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, healthyOnly := range []bool{true, false} {
+		n := len(p.members)
+		for i := 0; i < n; i++ {
+			// Rotate the starting point so ties are spread evenly
+			m := p.members[(p.rotation+i)%n]
+			if tried[m] || m.draining || m.starting || (healthyOnly && !m.healthy) || !m.holds(pair) {
+				continue
+			}
+			if !m.breaker.ready(now) {
+				wait := max(m.breaker.openUntil.Sub(now), time.Second)
+				if blocked == 0 || wait < blocked {
+					blocked = wait
+				}
+				continue
+			}
+			if best == nil || m.outstanding < best.outstanding {
+				best = m
+			}
+		}
+		if best != nil {
+			break
+		}
+	}
+	if best == nil {
+		return nil, blocked
+	}
+
+	p.rotation++
+	best.outstanding++
+	best.served++
+	best.breaker.acquire()
+	return best, 0
+}
+
+// settle counts the outcome of a request sent to m against its circuit. A
+// request cancelled by its client says nothing about the server.
+func (p *upstreamPool) settle(m *upstreamMember, resp *http.Response, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if errors.Is(err, context.Canceled) {
+		m.breaker.trial = false
+		return
+	}
+	was := m.breaker.State()
+	if m.breaker.record(p.breaker, upstreamFailed(resp, err), time.Now()) {
+		slog.Warn("Circuit opened", "upstream", m.name, "url", m.url.String(),
+			"failures", m.breaker.failures, "open_for", time.Duration(p.breaker.OpenFor))
+	} else if was != circuitClosed && m.breaker.State() == circuitClosed {
+		slog.Info("Circuit closed", "upstream", m.name, "url", m.url.String())
+	}
+}
+
+// release ends a request sent to m, counting err against its health
+func (p *upstreamPool) release(m *upstreamMember, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m.outstanding--
+	if err != nil {
+		p.recordCheckLocked(m, err)
+	}
+}
+
+// run checks the health of the members and scales the replicas until the
+// pool is closed
+func (p *upstreamPool) run() {
+	ticker := time.NewTicker(time.Duration(p.cfg.HealthInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+			p.autoscale()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// check probes every member at once. The members to probe are chosen under
+// the lock, and only their results are recorded: a member that finishes
+// starting meanwhile waits for the next round.
+func (p *upstreamPool) check() {
+	// A suspended server would only time out; the idle policy resumes it
+	state, err := loadInstanceState()
+	if err != nil {
+		state = &instanceState{}
+	}
+
+	p.mu.Lock()
+	var probed []*upstreamMember
+	for _, m := range p.members {
+		if !m.starting && !(m.kind == memberServer && state.Suspended) {
+			probed = append(probed, m)
+		}
+	}
+	p.mu.Unlock()
+
+	results := make([]error, len(probed))
+	var wg sync.WaitGroup
+	for i, m := range probed {
+		if port, _ := strconv.Atoi(m.url.Port()); m.kind == memberServer && state.Warming(port) {
+			// The server answers before its warm-up has loaded the models
+			results[i] = errors.New("server is still warming up")
+			continue
+		}
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			results[i] = checkHealth(url)
+		}(i, strings.TrimSuffix(m.url.String(), "/"))
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, m := range probed {
+		p.recordCheckLocked(m, results[i])
+	}
+	p.updateCapacityLocked()
+}
+
+// recordCheckLocked ejects or admits m after a failed or passed check;
+// p.mu must be held
+func (p *upstreamPool) recordCheckLocked(m *upstreamMember, err error) {
+	if err == nil {
+		m.fails = 0
+		m.passes++
+		m.lastError = ""
+		if !m.healthy && m.passes >= p.cfg.AdmitAfter {
+			m.healthy = true
+			slog.Info("Upstream admitted", "upstream", m.name, "url", m.url.String())
+		}
+		return
+	}
+
+	m.passes = 0
+	m.fails++
+	m.lastError = err.Error()
+	if m.healthy && m.fails >= p.cfg.EjectAfter {
+		m.healthy = false
+		m.ejections++
+		slog.Warn("Upstream ejected", "upstream", m.name, "url", m.url.String(), "error", err)
+	}
+}
+
+// updateCapacityLocked lets the scheduler send max_concurrent requests to
+// each healthy member; p.mu must be held
+func (p *upstreamPool) updateCapacityLocked() {
+	if p.maxConcurrent <= 0 {
+		return
+	}
+	p.sched.SetMax(p.maxConcurrent * max(p.healthyLocked(), 1))
+}
+
+// healthyLocked counts the members taking requests; p.mu must be held
+func (p *upstreamPool) healthyLocked() int {
+	n := 0
+	for _, m := range p.members {
+		if m.healthy && !m.draining && !m.starting {
+			n++
+		}
+	}
+	return n
+}
+
+// replicasLocked returns the replicas that are not being removed; p.mu
+// must be held
+func (p *upstreamPool) replicasLocked() []*upstreamMember {
+	var replicas []*upstreamMember
+	for _, m := range p.members {
+		if m.kind == memberReplica && !m.draining {
+			replicas = append(replicas, m)
+		}
+	}
+	return replicas
+}
+
+// autoscale adds a replica when requests queue up, and removes one once
+// the other servers could have handled the load for ScaleDownAfter
+func (p *upstreamPool) autoscale() {
+	if p.cfg.MaxReplicas == 0 {
+		return
+	}
+	stats := p.sched.Stats()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+
+	healthy := p.healthyLocked()
+	replicas := p.replicasLocked()
+	starting := false
+	for _, m := range replicas {
+		starting = starting || m.starting
+	}
+
+	now := time.Now()
+	spare := p.maxConcurrent > 0 && stats.Active <= p.maxConcurrent*(healthy-1)
+	if stats.Waiting > 0 || !spare {
+		p.busyAt = now
+	}
+
+	switch {
+	case stats.Waiting >= p.cfg.ScaleUpQueue*max(healthy, 1) && len(replicas) < p.cfg.MaxReplicas && !starting:
+		slog.Info("Adding a replica", "waiting", stats.Waiting, "replicas", len(replicas)+1)
+		p.addReplicaLocked()
+	case len(replicas) > p.cfg.MinReplicas && now.Sub(p.busyAt) >= time.Duration(p.cfg.ScaleDownAfter):
+		m := replicas[len(replicas)-1]
+		slog.Info("Removing an idle replica", "upstream", m.name, "replicas", len(replicas)-1)
+		p.busyAt = now
+		p.removeReplicaLocked(m)
+	}
+}
+
+// addReplicaLocked starts a replica holding every language; p.mu must be
+// held
+func (p *upstreamPool) addReplicaLocked() {
+	p.replicaSeq++
+	p.startLocalLocked(memberReplica, fmt.Sprintf("replica-%d", p.replicaSeq), nil)
+}
+
+// startLocalLocked starts a local server on a free port, loading only
+// languages when set; it joins the rotation once it is ready and warmed up.
+// p.mu must be held.
+func (p *upstreamPool) startLocalLocked(kind, name string, languages []string) {
+	port, err := freePort("127.0.0.1")
+	if err != nil {
+		slog.Warn("Could not start local upstream", "upstream", name, "error", err)
+		return
+	}
+	b, err := newBackend(p.backend, StartOptions{Host: "127.0.0.1", Port: port, LoadOnly: languages})
+	if err != nil {
+		slog.Warn("Could not start local upstream", "upstream", name, "error", err)
+		return
+	}
+	u, _ := url.Parse(b.URL())
+
+	m := &upstreamMember{name: name, kind: kind, url: u, backend: b, languages: languages, starting: true}
+	p.members = append(p.members, m)
+	go p.runLocal(m)
+}
+
+// runLocal starts the server of m and waits for it to exit. A shard that
+// exits on its own is started again, as its languages have no other home.
+func (p *upstreamPool) runLocal(m *upstreamMember) {
+	slog.Info("Starting local upstream", "upstream", m.name, "kind", m.kind, "url", m.url.String())
+	err := m.backend.Start()
+	if err == nil {
+		p.mu.Lock()
+		m.started = true
+		closed := p.closed
+		p.mu.Unlock()
+
+		exited := make(chan struct{})
+		if closed {
+			// The web interface is exiting; stopLocal missed this one
+			m.backend.Stop()
+		} else {
+			go p.awaitLocal(m, exited)
+		}
+		err = m.backend.Wait()
+		close(exited)
+	}
+
+	p.mu.Lock()
+	for i, member := range p.members {
+		if member == m {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	p.updateCapacityLocked()
+	expected := m.draining || p.closed
+	p.mu.Unlock()
+
+	if expected {
+		return
+	}
+	slog.Warn("Local upstream exited", "upstream", m.name, "error", err)
+	if m.kind == memberShard {
+		time.AfterFunc(shardRestartDelay, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if !p.closed {
+				p.startLocalLocked(m.kind, m.name, m.languages)
+			}
+		})
+	}
+}
+
+// awaitLocal admits m once it answers and its models are warmed up
+func (p *upstreamPool) awaitLocal(m *upstreamMember, exited <-chan struct{}) {
+	deadline := time.Now().Add(10 * time.Minute)
+	for m.backend.Health() != nil {
+		if time.Now().After(deadline) {
+			slog.Warn("Local upstream did not become ready, stopping it", "upstream", m.name)
+			m.backend.Stop()
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	if p.warmup.Enabled {
+		cfg := p.warmup
+		cfg.Pairs = m.warmupPairs(cfg.Pairs)
+		if _, err := warmUp(m.backend.URL(), cfg, nil); err != nil {
+			slog.Warn("Skipped warm-up", "upstream", m.name, "error", err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.starting = false
+	m.healthy = true
+	p.updateCapacityLocked()
+	slog.Info("Local upstream ready", "upstream", m.name, "url", m.url.String())
+}
+
+// removeReplicaLocked takes m out of rotation and stops it once its
+// requests are done; p.mu must be held
+func (p *upstreamPool) removeReplicaLocked(m *upstreamMember) {
+	m.draining = true
+	p.updateCapacityLocked()
+
+	go func() {
+		deadline := time.Now().Add(time.Duration(p.backend.StopTimeout))
+		for time.Now().Before(deadline) {
+			p.mu.Lock()
+			outstanding := m.outstanding
+			p.mu.Unlock()
+			if outstanding == 0 {
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		if err := m.backend.Stop(); err != nil {
+			slog.Warn("Could not stop replica", "upstream", m.name, "error", err)
+		}
+	}()
+}
+
+// stopLocal stops every replica and shard
+func (p *upstreamPool) stopLocal() {
+	p.mu.Lock()
+	p.closed = true
+	var started []*upstreamMember
+	for _, m := range p.members {
+		if m.backend != nil && m.started {
+			m.draining = true
+			started = append(started, m)
+		}
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range started {
+		wg.Add(1)
+		go func(m *upstreamMember) {
+			defer wg.Done()
+			slog.Info("Stopping local upstream", "upstream", m.name)
+			m.backend.Stop()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// Stats returns the state of every member
+func (p *upstreamPool) Stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := poolStats{
+		Healthy:     p.healthyLocked(),
+		Replicas:    len(p.replicasLocked()),
+		Shards:      len(p.shards),
+		Retries:     p.retries,
+		MinReplicas: p.cfg.MinReplicas,
+		MaxReplicas: p.cfg.MaxReplicas,
+	}
+	for _, m := range p.members {
+		stats.Members = append(stats.Members, poolMemberStats{
+			Name:        m.name,
+			Kind:        m.kind,
+			URL:         m.url.String(),
+			Languages:   m.languages,
+			Healthy:     m.healthy && !m.starting,
+			Starting:    m.starting,
+			Draining:    m.draining,
+			Outstanding: m.outstanding,
+			Served:      m.served,
+			Ejections:   m.ejections,
+			LastError:   m.lastError,
+			Circuit:     m.breaker.State(),
+			Trips:       m.breaker.trips,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPool creates a pool of the server at primary and the servers in
+// urls, with the defaults changed by configure
+func newTestPool(t *testing.T, primary string, urls []string, configure func(*Config)) *upstreamPool {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Backend.Type = "external"
+	cfg.Pool.URLs = urls
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	p, err := newUpstreamPool(cfg, primary, newUpstreamScheduler(cfg.Limits.MaxConcurrent, cfg.Limits.MaxQueue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+// poolRequest sends a request through p, returning its status
+func poolRequest(t *testing.T, p *upstreamPool, method, path string, body []byte) (int, error) {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://pool"+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// memberStats returns the statistics of the member of p called name
+func memberStats(t *testing.T, p *upstreamPool, name string) poolMemberStats {
+	t.Helper()
+	for _, m := range p.Stats().Members {
+		if m.Name == name {
+			return m
+		}
+	}
+	t.Fatalf("no member %s in the pool", name)
+	return poolMemberStats{}
+}
+
+func TestPoolFailoverAndEjection(t *testing.T) {
+	down := newStoppedFake(t, FakeConfig{})
+	up := startFake(t, FakeConfig{})
+	p := newTestPool(t, down.URL(), []string{up.URL()}, nil)
+
+	// Requests reach the other member while the server refuses connections
+	for i := 0; i < 4; i++ {
+		if status, err := poolRequest(t, p, http.MethodGet, "/languages", nil); err != nil || status != http.StatusOK {
+			t.Fatalf("request %d failed over to %d, %v", i+1, status, err)
+		}
+	}
+
+	for i := 0; i < p.cfg.EjectAfter; i++ {
+		p.check()
+	}
+	server := memberStats(t, p, memberServer)
+	if server.Healthy || server.Ejections != 1 || server.LastError == "" {
+		t.Fatalf("failing server not ejected: %+v", server)
+	}
+	if healthy := p.Stats().Healthy; healthy != 1 {
+		t.Fatalf("%d healthy members, want 1", healthy)
+	}
+
+	served := server.Served
+	for i := 0; i < 4; i++ {
+		if status, err := poolRequest(t, p, http.MethodGet, "/languages", nil); err != nil || status != http.StatusOK {
+			t.Fatalf("request %d after ejection answered %d, %v", i+1, status, err)
+		}
+	}
+	if got := memberStats(t, p, memberServer).Served; got != served {
+		t.Fatalf("ejected server was sent %d requests", got-served)
+	}
+
+	// Once the server is back, passed checks admit it again
+	if err := down.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { down.Stop() })
+	for i := 0; i < p.cfg.AdmitAfter; i++ {
+		p.check()
+	}
+	if server := memberStats(t, p, memberServer); !server.Healthy {
+		t.Fatalf("recovered server not admitted: %+v", server)
+	}
+	if healthy := p.Stats().Healthy; healthy != 2 {
+		t.Fatalf("%d healthy members, want 2", healthy)
+	}
+}
+
+func TestPoolRetriesSingleServer(t *testing.T) {
+	body := []byte(`{"q": "Hello", "source": "en", "target": "es"}`)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The retry must carry the body again
+		if got, _ := io.ReadAll(r.Body); !bytes.Equal(got, body) {
+			writeJSONError(w, http.StatusBadRequest, "body not replayed")
+			return
+		}
+		if calls.Add(1) == 1 {
+			writeJSONError(w, http.StatusServiceUnavailable, "busy")
+			return
+		}
+		w.Write([]byte(`{"translatedText": "[es] Hello"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	p := newTestPool(t, upstream.URL, nil, func(cfg *Config) {
+		cfg.Proxy.Retry.Backoff = Duration(10 * time.Millisecond)
+	})
+
+	if status, err := poolRequest(t, p, http.MethodPost, "/translate", body); err != nil || status != http.StatusOK {
+		t.Fatalf("retried translation answered %d, %v", status, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("server got %d calls, want 2", n)
+	}
+	if retries := p.Stats().Retries; retries != 1 {
+		t.Fatalf("%d retries counted, want 1", retries)
+	}
+
+	// Routes left out of the retry list are sent once
+	calls.Store(0)
+	if status, _ := poolRequest(t, p, http.MethodPost, "/translate_file", body); status != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("file translation answered %d after %d calls", status, calls.Load())
+	}
+}
+
+func TestPoolCloseStopsHealthChecks(t *testing.T) {
+	b := startFake(t, FakeConfig{})
+	p := newTestPool(t, b.URL(), nil, func(cfg *Config) {
+		cfg.Pool.HealthInterval = Duration(10 * time.Millisecond)
+	})
+	checks := func() int {
+		lines, _ := b.Logs(1000)
+		n := 0
+		for _, line := range lines {
+			if strings.HasSuffix(line, "GET /languages") {
+				n++
+			}
+		}
+		return n
+	}
+	waitFor(t, "a health check", func() bool { return checks() > 0 })
+
+	p.Close()
+	time.Sleep(20 * time.Millisecond)
+	closed := checks()
+	time.Sleep(50 * time.Millisecond)
+	if n := checks(); n != closed {
+		t.Fatalf("%d health checks after Close", n-closed)
+	}
+}
+
+func TestPoolRejectsHealthInterval(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Pool.HealthInterval = 0
+	if _, err := newUpstreamPool(cfg, "http://127.0.0.1:1", newUpstreamScheduler(1, 1)); err == nil {
+		t.Fatal("pool created without health checks")
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"pool": {"health_interval": "0s"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "health_interval") {
+		t.Fatalf("loading a zero health interval returned %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultServerPort is where LibreTranslate listens unless told otherwise
+const defaultServerPort = 5000
+
+// portAuto asks for any free port instead of a fixed one
+const portAuto = "auto"
+
+// portOwner is the process listening on a port, as far as the OS tells
+type portOwner struct {
+	PID     int
+	Command string
+}
+
+func (o portOwner) String() string {
+	if o.Command == "" {
+		return fmt.Sprintf("pid %d", o.PID)
+	}
+	return fmt.Sprintf("%s (pid %d)", o.Command, o.PID)
+}
+
+// portInUseError reports a port held by something other than our server
+type portInUseError struct {
+	Port  int
+	Owner *portOwner
+}
+
+func (e *portInUseError) Error() string {
+	if e.Owner != nil {
+		return fmt.Sprintf("port %d is already in use by %s; stop it or choose another port with --port (or --port auto)", e.Port, e.Owner)
+	}
+	return fmt.Sprintf("port %d is already in use by another program; choose another port with --port (or --port auto)", e.Port)
+}
+
+// parsePort reads a port number or "auto", which is returned as 0
+func parsePort(s string) (int, error) {
+	if s == portAuto {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q (expected 1-65535 or %s)", s, portAuto)
+	}
+	return port, nil
+}
+
+// checkPortFree returns a *portInUseError when the server could not listen
+// on host:port. A connection attempt catches programs bound to every
+// interface, which some systems let a more specific address shadow.
+func checkPortFree(host string, port int) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if isUnspecifiedHost(host) {
+		addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	}
+	if conn, err := net.DialTimeout("tcp", addr, 500*time.Millisecond); err == nil {
+		conn.Close()
+		return &portInUseError{Port: port, Owner: findPortOwner(port)}
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return &portInUseError{Port: port, Owner: findPortOwner(port)}
+	}
+	return ln.Close()
+}
+
+// freePort asks the OS for a port nothing listens on
+func freePort(host string) (int, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// findPortOwner identifies the process listening on port, or returns nil
+// when the OS does not say
+func findPortOwner(port int) *portOwner {
+	owner, err := portOwnerOf(port)
+	if err != nil {
+		return nil
+	}
+	return owner
+}
+
+// serverPort returns the port of the server last started by this tool, so
+// that commands and the web proxy follow a server started with --port auto
+func serverPort() int {
+	state, err := loadInstanceState()
+	if err != nil || state.Port == 0 {
+		return defaultServerPort
+	}
+	return state.Port
+}
+
+// servesPort reports whether the server recorded in the state is the one
+// listening on port, rather than an unrelated program
+func (s *instanceState) servesPort(port int) bool {
+	if s.Port != port {
+		return false
+	}
+	if s.Backend == "native" {
+		return s.PID != 0 && s.verifyProcess() == nil
+	}
+	return true
+}
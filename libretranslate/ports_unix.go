@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// lsofPortOwner asks lsof which process listens on port
+func lsofPortOwner(port int) (*portOwner, error) {
+	output, err := exec.Command("lsof", "-nP", fmt.Sprintf("-iTCP:%d", port), "-sTCP:LISTEN", "-Fpc").Output()
+	if err != nil {
+		return nil, fmt.Errorf("lsof found no listener on port %d", port)
+	}
+
+	// -F prints one field per line: p<pid>, then c<command>
+	owner := &portOwner{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "p") && owner.PID == 0:
+			owner.PID, _ = strconv.Atoi(line[1:])
+		case strings.HasPrefix(line, "c") && owner.Command == "":
+			owner.Command = line[1:]
+		}
+	}
+	if owner.PID == 0 {
+		return nil, fmt.Errorf("unexpected lsof output")
+	}
+	return owner, nil
+}
@@ -0,0 +1,181 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is the kernel USER_HZ, which is 100 on every Linux platform Go supports
+const clockTicks = 100
+
+// processStats sums the resident memory, CPU time and threads of the
+// processes in the group led by pid, read from /proc
+func processStats(pid int) (procStats, error) {
+	leader, err := readStat(pid)
+	if err != nil {
+		return procStats{}, err
+	}
+
+	stats := procStats{}
+	add := func(st statFields) {
+		stats.RSSBytes += st.rssPages * uint64(os.Getpagesize())
+		stats.CPUSeconds += float64(st.utime+st.stime) / clockTicks
+		stats.Threads += st.threads
+		stats.Processes++
+	}
+	add(leader)
+
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range procs {
+		other, _ := strconv.Atoi(filepath.Base(dir))
+		if other == pid {
+			continue
+		}
+		if st, err := readStat(other); err == nil && st.pgrp == pid {
+			add(st)
+		}
+	}
+	return stats, nil
+}
+
+// statFields are the fields of /proc/<pid>/stat used for statistics
+type statFields struct {
+	pgrp         int
+	utime, stime uint64
+	threads      int
+	rssPages     uint64
+}
+
+// readStat parses /proc/<pid>/stat
+func readStat(pid int) (statFields, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return statFields{}, err
+	}
+	// The command name may contain spaces, so split after its closing paren
+	rest := string(stat)
+	if i := strings.LastIndexByte(rest, ')'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	// Fields are numbered from 1 in proc(5); the name is field 2, so field
+	// n is at index n-3 here: pgrp 5, utime 14, stime 15, num_threads 20,
+	// rss 24
+	fields := strings.Fields(rest)
+	if len(fields) < 22 {
+		return statFields{}, fmt.Errorf("unexpected stat format")
+	}
+
+	var st statFields
+	st.pgrp, _ = strconv.Atoi(fields[2])
+	st.utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	st.stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	st.threads, _ = strconv.Atoi(fields[17])
+	st.rssPages, _ = strconv.ParseUint(fields[21], 10, 64)
+	return st, nil
+}
+
+// processIdentity reads the start time and command line of pid from /proc
+func processIdentity(pid int) (procIdentity, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procIdentity{}, err
+	}
+	rest := string(stat)
+	if i := strings.LastIndexByte(rest, ')'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	// starttime is field 22 of stat, 20 after the name
+	fields := strings.Fields(rest)
+	if len(fields) < 20 {
+		return procIdentity{}, fmt.Errorf("unexpected stat format")
+	}
+	if fields[0] == "Z" {
+		return procIdentity{}, fmt.Errorf("process %d has exited", pid)
+	}
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return procIdentity{}, err
+	}
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+
+	return procIdentity{StartTime: fields[19], Cmdline: strings.Join(args, " ")}, nil
+}
+
+// processZombie reports whether pid has exited without being reaped
+func processZombie(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	rest := string(stat)
+	if i := strings.LastIndexByte(rest, ')'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	// state is field 3 of stat, the first after the name
+	fields := strings.Fields(rest)
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// portOwnerOf finds the process listening on port by matching the socket
+// inode from /proc/net/tcp against open file descriptors. Sockets of other
+// users' processes cannot be read without privileges, so lsof gets a try.
+func portOwnerOf(port int) (*portOwner, error) {
+	inodes := listeningInodes(port)
+	if len(inodes) == 0 {
+		return lsofPortOwner(port)
+	}
+
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range procs {
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if !inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+				continue
+			}
+			pid, _ := strconv.Atoi(filepath.Base(dir))
+			comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+			return &portOwner{PID: pid, Command: strings.TrimSpace(string(comm))}, nil
+		}
+	}
+	return lsofPortOwner(port)
+}
+
+// listeningInodes returns the inodes of the sockets listening on port
+func listeningInodes(port int) map[string]bool {
+	const stateListen = "0A"
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != stateListen {
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			if p, err := strconv.ParseUint(hexPort, 16, 16); err == nil && int(p) == port && fields[9] != "0" {
+				inodes[fields[9]] = true
+			}
+		}
+	}
+	return inodes
+}
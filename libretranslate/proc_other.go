@@ -0,0 +1,43 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processStats is only implemented on Linux
+func processStats(pid int) (procStats, error) {
+	return procStats{}, fmt.Errorf("process statistics are not supported on this platform")
+}
+
+// processIdentity asks ps for the start time and command line of pid
+func processIdentity(pid int) (procIdentity, error) {
+	start, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return procIdentity{}, fmt.Errorf("process %d not found", pid)
+	}
+	command, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return procIdentity{}, fmt.Errorf("process %d not found", pid)
+	}
+
+	return procIdentity{
+		StartTime: strings.TrimSpace(string(start)),
+		Cmdline:   strings.TrimSpace(string(command)),
+	}, nil
+}
+
+// processZombie asks ps whether pid has exited without being reaped
+func processZombie(pid int) bool {
+	state, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && strings.HasPrefix(strings.TrimSpace(string(state)), "Z")
+}
+
+// portOwnerOf asks lsof which process listens on port
+func portOwnerOf(port int) (*portOwner, error) {
+	return lsofPortOwner(port)
+}
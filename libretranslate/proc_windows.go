@@ -0,0 +1,63 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processStats is only implemented on Linux
+func processStats(pid int) (procStats, error) {
+	return procStats{}, fmt.Errorf("process statistics are not supported on this platform")
+}
+
+// processIdentity asks Windows for the creation date and command line of pid
+func processIdentity(pid int) (procIdentity, error) {
+	script := fmt.Sprintf(`$p = Get-CimInstance Win32_Process -Filter "ProcessId=%d"; if (-not $p) { exit 1 }; $p.CreationDate.ToString("o"); $p.CommandLine`, pid)
+	output, err := exec.Command("powershell", "-NoProfile", "-Command", script).Output()
+	if err != nil {
+		return procIdentity{}, fmt.Errorf("process %d not found", pid)
+	}
+
+	lines := strings.SplitN(strings.ReplaceAll(string(output), "\r\n", "\n"), "\n", 2)
+	if len(lines) < 2 {
+		return procIdentity{}, fmt.Errorf("unexpected process information for %d", pid)
+	}
+	return procIdentity{StartTime: strings.TrimSpace(lines[0]), Cmdline: strings.TrimSpace(lines[1])}, nil
+}
+
+// portOwnerOf finds the process listening on port with netstat and names it
+// with tasklist
+func portOwnerOf(port int) (*portOwner, error) {
+	output, err := exec.Command("netstat", "-ano", "-p", "TCP").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := ":" + strconv.Itoa(port)
+	for _, line := range strings.Split(string(output), "\n") {
+		// Proto  Local Address  Foreign Address  State  PID; the state name is
+		// localized, but listening sockets have no foreign port
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasSuffix(fields[2], ":0") || !strings.HasSuffix(fields[1], suffix) {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil {
+			continue
+		}
+
+		owner := &portOwner{PID: pid}
+		task, err := exec.Command("tasklist", "/FI", fmt.Sprintf("PID eq %d", pid), "/FO", "CSV", "/NH").Output()
+		if err == nil {
+			if name, _, ok := strings.Cut(strings.TrimSpace(string(task)), ","); ok {
+				owner.Command = strings.Trim(name, `"`)
+			}
+		}
+		return owner, nil
+	}
+	return nil, fmt.Errorf("no listener found on port %d", port)
+}
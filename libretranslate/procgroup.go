@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// stopProcessGroup shuts down the process group led by pid. The leader is
+// asked to terminate and given up to timeout to drain in-flight requests
+// and stop its workers; whatever is left of the group is then killed.
+func stopProcessGroup(pid int, timeout time.Duration) error {
+	slog.Info("Stopping server process", "pid", pid, "timeout", timeout)
+	if err := terminateProcess(pid); err != nil && processAlive(pid) {
+		slog.Warn("Could not request graceful shutdown", "pid", pid, "error", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if processAlive(pid) {
+		slog.Warn("Server did not exit in time, killing its process group", "pid", pid, "timeout", timeout)
+	}
+
+	return killProcessGroup(pid)
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group, so that the
+// workers it forks can be signalled together
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcess asks the group leader pid to shut down gracefully; it
+// stops its own workers. A suspended group is resumed so that it can act
+// on the signal.
+func terminateProcess(pid int) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	syscall.Kill(-pid, syscall.SIGCONT)
+	return nil
+}
+
+// suspendProcessGroup pauses every process in the group led by pid
+func suspendProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGSTOP)
+}
+
+// resumeProcessGroup continues a group paused by suspendProcessGroup
+func resumeProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGCONT)
+}
+
+// killProcessGroup kills every process left in the group led by pid
+func killProcessGroup(pid int) error {
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// processAlive reports whether pid still runs. A zombie has exited, even
+// though it exists until its parent reaps it.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return (err == nil || errors.Is(err, syscall.EPERM)) && !processZombie(pid)
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestStopProcessGroupUnreapedChild(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	// Nobody reaps the child while it is stopped, so it lingers as a zombie
+	start := time.Now()
+	if err := stopProcessGroup(cmd.Process.Pid, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("stopping an exited child took %s", took.Round(time.Millisecond))
+	}
+	if processAlive(cmd.Process.Pid) {
+		t.Fatal("exited child is reported alive")
+	}
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a new process group so that console signals
+// meant for the manager do not reach it
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// terminateProcess asks pid and its children to close
+func terminateProcess(pid int) error {
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// killProcessGroup forcibly ends pid and every process it started
+func killProcessGroup(pid int) error {
+	if !processAlive(pid) {
+		return nil
+	}
+	return exec.Command("taskkill", "/F", "/T", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// processAlive reports whether pid still exists
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// errSuspendUnsupported is returned where processes cannot be paused
+var errSuspendUnsupported = errors.New("suspending the server is not supported on Windows")
+
+// suspendProcessGroup is not supported on Windows
+func suspendProcessGroup(pid int) error { return errSuspendUnsupported }
+
+// resumeProcessGroup is not supported on Windows
+func resumeProcessGroup(pid int) error { return errSuspendUnsupported }
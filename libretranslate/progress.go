@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Startup phases, in the order LibreTranslate goes through them
+const (
+	phaseStarting    = "starting"
+	phaseDownloading = "downloading"
+	phaseLoading     = "loading"
+	phaseBinding     = "binding"
+	phaseWarming     = "warming"
+	phaseReady       = "ready"
+	phaseFailed      = "failed"
+)
+
+// startupPhases lists the phases that happen before the server is ready
+var startupPhases = []string{phaseStarting, phaseDownloading, phaseLoading, phaseBinding, phaseWarming}
+
+// progressFile holds the progress of the current or last start, so the web
+// interface can report it whichever process started the server
+var progressFile = filepath.Join(os.TempDir(), "libretranslate.progress.json")
+
+// maxStartupHistory is the number of past starts used to estimate the ETA
+const maxStartupHistory = 10
+
+// Patterns in the startup output of LibreTranslate and Argos Translate
+var (
+	updatingModelsPattern = regexp.MustCompile(`(?i)updating language models`)
+	foundModelsPattern    = regexp.MustCompile(`(?i)found (\d+) models`)
+	downloadPattern       = regexp.MustCompile(`(?i)\b(?:downloading|installing)\s+(.+?)\s*(?:\.\.\.)?$`)
+	loadingPattern        = regexp.MustCompile(`(?i)\bloading\s+(?:language\s+)?(?:models?|packages?|languages?|translators?)\b:?\s*(.*)$`)
+	loadedPattern         = regexp.MustCompile(`(?i)loaded support for (\d+) languages`)
+	bindingPattern        = regexp.MustCompile(`(?i)(?:running on|serving on|listening at:?|listening on)\s+(https?://\S+)`)
+)
+
+// startupProgress follows a server start through its phases
+type startupProgress struct {
+	mu      sync.Mutex
+	active  bool
+	state   progressState
+	history []startupRecord
+}
+
+// progressState is the progress reported to users and the web API
+type progressState struct {
+	Phase     string          `json:"phase"`
+	Detail    string          `json:"detail,omitempty"`
+	Backend   string          `json:"backend"`
+	StartedAt time.Time       `json:"started_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Elapsed   float64         `json:"elapsed_secs"`
+	ETA       *float64        `json:"eta_secs,omitempty"`
+	Phases    []phaseProgress `json:"phases"`
+	// Models counts downloads against the total LibreTranslate announced
+	ModelsDownloaded int    `json:"models_downloaded"`
+	ModelsTotal      int    `json:"models_total,omitempty"`
+	LanguagesLoaded  int    `json:"languages_loaded,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// phaseProgress is the time spent in one phase
+type phaseProgress struct {
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration_secs"`
+}
+
+// startupRecord is how long a successful start took, phase by phase
+type startupRecord struct {
+	At     time.Time          `json:"at"`
+	Total  float64            `json:"total_secs"`
+	Phases map[string]float64 `json:"phases"`
+}
+
+// serverProgress tracks the start in progress in this process
+var serverProgress = &startupProgress{}
+
+// startupHistoryPath returns the file keeping the durations of past starts
+func startupHistoryPath() string {
+	return filepath.Join(configDir(), "startup_history.json")
+}
+
+// Begin starts tracking a new start of backend
+func (p *startupProgress) Begin(backend string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.active = true
+	p.history = loadStartupHistory()
+	p.state = progressState{
+		Phase:     phaseStarting,
+		Backend:   backend,
+		StartedAt: now,
+		UpdatedAt: now,
+		Phases:    []phaseProgress{{Name: phaseStarting, StartedAt: now}},
+	}
+	p.saveLocked()
+}
+
+// Observe updates the progress from a line of LibreTranslate output
+func (p *startupProgress) Observe(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.active {
+		return
+	}
+
+	switch {
+	case updatingModelsPattern.MatchString(line):
+		p.enterLocked(phaseDownloading, "")
+	case foundModelsPattern.MatchString(line):
+		m := foundModelsPattern.FindStringSubmatch(line)
+		p.state.ModelsTotal, _ = strconv.Atoi(m[1])
+		p.enterLocked(phaseDownloading, "")
+	case downloadPattern.MatchString(line):
+		m := downloadPattern.FindStringSubmatch(line)
+		p.state.ModelsDownloaded++
+		p.enterLocked(phaseDownloading, m[1])
+	case loadedPattern.MatchString(line):
+		m := loadedPattern.FindStringSubmatch(line)
+		p.state.LanguagesLoaded, _ = strconv.Atoi(m[1])
+		p.enterLocked(phaseLoading, m[0])
+	case loadingPattern.MatchString(line):
+		m := loadingPattern.FindStringSubmatch(line)
+		p.enterLocked(phaseLoading, m[1])
+	case bindingPattern.MatchString(line):
+		m := bindingPattern.FindStringSubmatch(line)
+		p.enterLocked(phaseBinding, m[1])
+	}
+}
+
+// Enter moves to a phase this process reaches itself rather than by reading
+// the output of LibreTranslate, such as the warm-up
+func (p *startupProgress) Enter(phase, detail string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.active {
+		return
+	}
+	p.enterLocked(phase, detail)
+}
+
+// enterLocked moves to phase, logging the change; p.mu must be held
+func (p *startupProgress) enterLocked(phase, detail string) {
+	now := time.Now()
+	changed := phase != p.state.Phase
+	if changed {
+		p.closePhaseLocked(now)
+		p.state.Phase = phase
+		p.state.Phases = append(p.state.Phases, phaseProgress{Name: phase, StartedAt: now})
+	}
+	if detail != "" {
+		p.state.Detail = detail
+	} else if changed {
+		p.state.Detail = ""
+	}
+
+	if changed {
+		p.logLocked("Startup phase changed")
+	}
+	p.saveLocked()
+}
+
+// closePhaseLocked records the duration of the current phase
+func (p *startupProgress) closePhaseLocked(now time.Time) {
+	if n := len(p.state.Phases); n > 0 {
+		last := &p.state.Phases[n-1]
+		last.Duration = now.Sub(last.StartedAt).Seconds()
+	}
+}
+
+// Report logs the current phase with its elapsed time and ETA
+func (p *startupProgress) Report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.active {
+		return
+	}
+	p.logLocked("Waiting for server")
+	p.saveLocked()
+}
+
+// Finish ends tracking, recording the durations when the start succeeded
+func (p *startupProgress) Finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.active {
+		return
+	}
+	p.active = false
+
+	now := time.Now()
+	p.closePhaseLocked(now)
+	p.state.Detail = ""
+	if err != nil {
+		p.state.Phase = phaseFailed
+		p.state.Error = err.Error()
+		p.saveLocked()
+		return
+	}
+
+	p.state.Phase = phaseReady
+	p.saveLocked()
+
+	record := startupRecord{At: now, Total: now.Sub(p.state.StartedAt).Seconds(), Phases: make(map[string]float64)}
+	for _, phase := range p.state.Phases {
+		record.Phases[phase.Name] += phase.Duration
+	}
+	history := append(p.history, record)
+	if len(history) > maxStartupHistory {
+		history = history[len(history)-maxStartupHistory:]
+	}
+	if err := saveStartupHistory(history); err != nil {
+		slog.Warn("Could not save startup history", "error", err)
+	}
+}
+
+// logLocked logs the progress; p.mu must be held
+func (p *startupProgress) logLocked(msg string) {
+	p.updateTimesLocked(time.Now())
+
+	attrs := []interface{}{"phase", p.state.Phase, "elapsed", secondsDuration(p.state.Elapsed)}
+	if p.state.Detail != "" {
+		attrs = append(attrs, "detail", p.state.Detail)
+	}
+	if p.state.ModelsTotal > 0 {
+		attrs = append(attrs, "models", strconv.Itoa(p.state.ModelsDownloaded)+"/"+strconv.Itoa(p.state.ModelsTotal))
+	}
+	if p.state.ETA != nil {
+		attrs = append(attrs, "eta", secondsDuration(*p.state.ETA))
+	}
+	slog.Info(msg, attrs...)
+}
+
+// secondsDuration converts seconds to a duration rounded for display
+func secondsDuration(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second)).Round(time.Second)
+}
+
+// updateTimesLocked refreshes the elapsed time and ETA; p.mu must be held
+func (p *startupProgress) updateTimesLocked(now time.Time) {
+	p.state.Elapsed = now.Sub(p.state.StartedAt).Seconds()
+	p.state.ETA = estimateRemaining(p.history, p.state, now)
+}
+
+// saveLocked writes the progress file; p.mu must be held
+func (p *startupProgress) saveLocked() {
+	now := time.Now()
+	p.state.UpdatedAt = now
+	p.updateTimesLocked(now)
+	data, err := json.MarshalIndent(p.state, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(progressFile, data, 0644); err != nil {
+		slog.Debug("Could not save startup progress", "error", err)
+	}
+}
+
+// estimateRemaining predicts the time left from the average duration of
+// each phase in past starts, or returns nil without history
+func estimateRemaining(history []startupRecord, state progressState, now time.Time) *float64 {
+	if len(history) == 0 || state.Phase == phaseReady || state.Phase == phaseFailed {
+		return nil
+	}
+
+	average := make(map[string]float64)
+	for _, record := range history {
+		for phase, secs := range record.Phases {
+			average[phase] += secs / float64(len(history))
+		}
+	}
+
+	current := -1
+	for i, phase := range startupPhases {
+		if phase == state.Phase {
+			current = i
+		}
+	}
+	if current < 0 {
+		return nil
+	}
+
+	inPhase := 0.0
+	if n := len(state.Phases); n > 0 {
+		inPhase = now.Sub(state.Phases[n-1].StartedAt).Seconds()
+	}
+
+	remaining := average[state.Phase] - inPhase
+	if remaining < 0 {
+		remaining = 0
+	}
+	for _, phase := range startupPhases[current+1:] {
+		remaining += average[phase]
+	}
+	return &remaining
+}
+
+// loadStartupHistory reads the durations of past starts
+func loadStartupHistory() []startupRecord {
+	data, err := os.ReadFile(startupHistoryPath())
+	if err != nil {
+		return nil
+	}
+	var history []startupRecord
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil
+	}
+	return history
+}
+
+// saveStartupHistory writes the durations of past starts
+func saveStartupHistory(history []startupRecord) error {
+	if err := os.MkdirAll(filepath.Dir(startupHistoryPath()), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(startupHistoryPath(), data, 0644)
+}
+
+// readProgress returns the progress of the current or last start, with the
+// elapsed time brought up to date while it is still running
+func readProgress() (*progressState, error) {
+	data, err := os.ReadFile(progressFile)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &progressState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Phase != phaseReady && state.Phase != phaseFailed {
+		now := time.Now()
+		state.Elapsed = now.Sub(state.StartedAt).Seconds()
+		if state.ETA != nil {
+			eta := *state.ETA - now.Sub(state.UpdatedAt).Seconds()
+			if eta < 0 {
+				eta = 0
+			}
+			state.ETA = &eta
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamTransport is shared by every request sent to LibreTranslate
+var upstreamTransport = &http.Transport{
+	DialContext: dialUpstream(&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}),
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 32,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// keyedRoutes are the translating routes other than /translate, whose API
+// keys are checked and metered like those of /translate
+var keyedRoutes = []string{"/translate_file", "/detect", "/suggest"}
+
+// errResponseCutOff is returned when LibreTranslate stopped sending a
+// response the proxy was buffering
+var errResponseCutOff = errors.New("LibreTranslate stopped sending its response")
+
+// libreTranslateProxy is a streaming reverse proxy for the whole LibreTranslate
+// API and web UI, adding CORS headers so browsers can use it from one origin
+type libreTranslateProxy struct {
+	cfg     ProxyConfig
+	keysCfg KeysConfig
+	limits  LimitsConfig
+	cors    *corsPolicy
+	keys    *keyStore
+	sched   *upstreamScheduler
+	limiter *rateLimiter
+	flights *flightGroup
+	metrics *proxyMetrics
+	tracer  *tracer
+	proxy   *httputil.ReverseProxy
+	// pool holds the servers requests go to, and picks one for each
+	pool *upstreamPool
+	// chain tries other translation backends when the local server cannot
+	// translate; nil when no fallback is configured
+	chain *translationChain
+	// idle stops and restarts the server with the traffic, when enabled
+	idle *idleManager
+	// cassette records or replays the exchanges with LibreTranslate; nil
+	// when neither is configured
+	cassette *cassette
+	// chaos injects faults into answers while enabled
+	chaos *chaosInjector
+}
+
+// newLibreTranslateProxy creates a proxy forwarding to the server at target
+// and the other servers of the pool
+func newLibreTranslateProxy(target string, cfg Config) (*libreTranslateProxy, error) {
+	keys, err := loadKeyStore(cfg.Keys.File)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := newTracer(cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &libreTranslateProxy{
+		cfg:     cfg.Proxy,
+		keysCfg: cfg.Keys,
+		limits:  cfg.Limits,
+		cors:    newCORSPolicy(cfg.CORS),
+		keys:    keys,
+		sched:   newUpstreamScheduler(cfg.Limits.MaxConcurrent, cfg.Limits.MaxQueue),
+		limiter: newRateLimiter(cfg.Limits.RatePerSecond, cfg.Limits.Burst),
+		flights: newFlightGroup(),
+		metrics: newProxyMetrics(),
+		tracer:  tracer,
+	}
+	if cfg.Cassette.Mode == cassetteReplay {
+		// Replaying needs no LibreTranslate, so none is started
+		cfg.Shards = nil
+		cfg.Pool.MinReplicas, cfg.Pool.MaxReplicas = 0, 0
+		cfg.Idle.After, cfg.Idle.LazyStart = 0, false
+	}
+	p.pool, err = newUpstreamPool(cfg, target, p.sched)
+	if err != nil {
+		return nil, err
+	}
+	p.cassette, err = newCassette(cfg.Cassette, p.pool)
+	if err != nil {
+		return nil, err
+	}
+	p.chain, err = newTranslationChain(cfg.Fallback, p, p.metrics)
+	if err != nil {
+		return nil, err
+	}
+	p.chaos, err = newChaosInjector(cfg.Chaos, p.metrics)
+	if err != nil {
+		return nil, err
+	}
+	p.metrics.watchProxy(p)
+	p.idle = newIdleManager(cfg.Idle, cfg.Backend.Type, p.pool.Sharded(), p.metrics)
+	p.proxy = &httputil.ReverseProxy{
+		// The pool fills in the server of each request
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			// Make the upstream call the parent of LibreTranslate's work
+			if s := spanFrom(pr.In.Context()); s != nil {
+				pr.Out.Header.Set("traceparent", s.Traceparent())
+			}
+		},
+		Transport: p.transport(),
+		// Flush immediately so response bodies are streamed
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			route := routeLabel(resp.Request.URL.Path)
+			p.metrics.upstreamRequests.Inc(route)
+			if resp.StatusCode >= 500 {
+				p.metrics.upstreamErrors.Inc(route, "status_5xx")
+			}
+
+			// LibreTranslate sends its own CORS headers; ours take precedence
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					resp.Header.Del(name)
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			route := routeLabel(r.URL.Path)
+			p.metrics.upstreamRequests.Inc(route)
+			body := map[string]interface{}{"error": fmt.Sprintf("LibreTranslate server not responding: %v", err)}
+			status, kind := http.StatusBadGateway, "connect"
+			var open *errCircuitOpen
+			var miss *errCassetteMiss
+			if errors.As(err, &open) {
+				status, kind = http.StatusServiceUnavailable, "circuit_open"
+				retry := retryAfterSeconds(open.retryAfter)
+				w.Header().Set("Retry-After", retry)
+				body["error"] = open.Error()
+				body["retry_after"], _ = strconv.Atoi(retry)
+			} else if errors.As(err, &miss) {
+				kind = "cassette_miss"
+				body["error"] = miss.Error()
+			} else if errors.Is(err, errNoUpstream) {
+				status, kind = http.StatusServiceUnavailable, "no_upstream"
+			} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errHeaderTimeout) {
+				status, kind = http.StatusGatewayTimeout, "timeout"
+			} else if errors.Is(err, context.Canceled) {
+				kind = "cancelled"
+			}
+			p.metrics.upstreamErrors.Inc(route, kind)
+			body["kind"] = kind
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(body)
+		},
+	}
+
+	return p, nil
+}
+
+// transport returns what requests to LibreTranslate go through: the
+// cassette when there is one, and the pool otherwise
+func (p *libreTranslateProxy) transport() http.RoundTripper {
+	if p.cassette != nil {
+		return p.cassette
+	}
+	return p.pool
+}
+
+// Close stops the pool of the proxy
+func (p *libreTranslateProxy) Close() {
+	p.pool.Close()
+}
+
+// SetTarget points the proxy at the managed server at target
+func (p *libreTranslateProxy) SetTarget(target string) error {
+	return p.pool.SetPrimary(target)
+}
+
+func (p *libreTranslateProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := p.tracer.StartRequest(r, r.Method+" "+routeLabel(r.URL.Path))
+	info := &requestInfo{pair: "none"}
+	rec := &statusRecorder{ResponseWriter: w}
+
+	// Deferred, so that requests aborted with http.ErrAbortHandler count too
+	defer func() {
+		status := rec.Status()
+		if info.aborted {
+			status = statusNoResponse
+			span.SetError("connection dropped without an answer")
+		} else if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+		p.metrics.observe(r.URL.Path, info.pair, status, time.Since(start))
+		span.SetAttr("http.status_code", status)
+		span.SetAttr("lt.pair", info.pair)
+		span.End()
+	}()
+
+	p.serve(rec, r.WithContext(context.WithValue(ctx, requestInfoKey{}, info)))
+}
+
+// serve handles a request once it is instrumented
+func (p *libreTranslateProxy) serve(w http.ResponseWriter, r *http.Request) {
+	if !p.cors.Handle(w, r) {
+		return
+	}
+
+	if !p.allowed(r.URL.Path) {
+		http.Error(w, "Path not allowed by proxy configuration", http.StatusForbidden)
+		return
+	}
+
+	p.chaos.Serve(w, r, p.dispatch)
+}
+
+// dispatch sends an allowed request to the handler of its route
+func (p *libreTranslateProxy) dispatch(w http.ResponseWriter, r *http.Request) {
+	if p.idle != nil && !p.idle.Admit(w, r) {
+		return
+	}
+
+	ctx := withTimeouts(r.Context(), upstreamTimeouts{
+		Connect: routeTimeout(r.URL.Path, p.cfg.ConnectTimeout, p.cfg.RouteConnectTimeouts),
+		Header:  routeTimeout(r.URL.Path, p.cfg.HeaderTimeout, p.cfg.RouteHeaderTimeouts),
+	})
+	if timeout := p.timeoutFor(r.URL.Path); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+
+	switch {
+	case r.URL.Path == "/translate" && r.Method == http.MethodPost:
+		p.serveTranslate(w, r)
+	case slices.Contains(keyedRoutes, r.URL.Path) && r.Method == http.MethodPost:
+		p.serveKeyed(w, r)
+	case r.URL.Path == "/languages" && r.Method == http.MethodGet && p.pool.Sharded():
+		p.serveLanguages(w, r)
+	case r.URL.Path == "/scheduler/seek":
+		p.serveSeek(w, r)
+	default:
+		p.forward(w, r, "ip:"+clientIP(r), ticketFromHeaders(r))
+	}
+}
+
+// forward sends r upstream, applying the rate limit of client and the
+// scheduler to the routes configured for them
+func (p *libreTranslateProxy) forward(w http.ResponseWriter, r *http.Request, client string, ticket scheduleTicket) {
+	if !p.limited(r.URL.Path) {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	if !p.admit(w, client) {
+		return
+	}
+
+	release, err := p.acquire(r.Context(), newSharedTicket(ticket))
+	if err != nil {
+		p.writeSchedulerError(w, err)
+		return
+	}
+	defer release()
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// admit applies the rate limit of client, answering with 429 when exceeded
+func (p *libreTranslateProxy) admit(w http.ResponseWriter, client string) bool {
+	if ok, wait := p.limiter.Allow(client); !ok {
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+// writeSchedulerError answers a request the scheduler did not let through
+func (p *libreTranslateProxy) writeSchedulerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", retryAfterSeconds(p.sched.RetryAfter()))
+	}
+	status, message := schedulerError(err)
+	w.Header().Set("X-Scheduler-Status", schedulerStatus(err))
+	writeJSONError(w, status, message)
+}
+
+// limited reports whether path is subject to the rate and concurrency limits
+func (p *libreTranslateProxy) limited(path string) bool {
+	for _, prefix := range p.limits.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTranslate checks and meters the client's API key before forwarding a
+// translation, replacing it with the upstream key
+func (p *libreTranslateProxy) serveTranslate(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTranslateRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if info := infoFrom(r); info != nil {
+		info.pair = p.metrics.pairLabel(req.Source, req.Target)
+	}
+	if span := spanFrom(r.Context()); span != nil {
+		span.SetAttr("lt.source", req.Source)
+		span.SetAttr("lt.target", req.Target)
+		span.SetAttr("lt.chars", req.Chars())
+	}
+
+	// With a fallback chain, pairs the shards lack go to another backend
+	pair := languagePair{Source: req.Source, Target: req.Target}
+	if err := p.pool.CheckPair(pair); err != nil && p.chain == nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	r = r.WithContext(withPair(r.Context(), pair))
+
+	key, err := p.authorize(r, req.APIKey, req.Source, req.Target, req.Chars())
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	req.APIKey = p.keysCfg.UpstreamAPIKey
+	req.RemoteAddr = r.RemoteAddr
+	if err := req.setBody(r); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.Header.Del("Authorization")
+
+	client := p.clientID(r, key)
+	ticket := ticketFromHeaders(r)
+	applyTicketFields(&ticket, req.Priority, req.Deadline, req.Session, req.CueTime)
+	// Translators keeping context per session also accept it as a header
+	req.Session = ticket.Session
+
+	limited := p.limited(r.URL.Path)
+	if limited && !p.admit(w, client) {
+		return
+	}
+
+	flightKey, err := coalesceKey(req)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		ctx, lookup := p.tracer.Start(r.Context(), "coalesce", spanKindInternal)
+		resp, shared, err := p.flights.Do(ctx, flightKey, p.timeoutFor(r.URL.Path), ticket, func(ctx context.Context, ticket *sharedTicket) (*bufferedResponse, error) {
+			// Behind a fallback chain, only the local link takes a slot
+			if limited && p.chain == nil {
+				release, err := p.acquire(ctx, ticket)
+				if err != nil {
+					return nil, err
+				}
+				defer release()
+			} else if limited {
+				ctx = withTicket(ctx, ticket)
+			}
+
+			ctx, upstream := p.tracer.Start(ctx, "upstream "+r.URL.Path, spanKindClient)
+			defer upstream.End()
+
+			var rec *bufferedResponse
+			if p.chain != nil {
+				var err error
+				rec, err = p.chain.Translate(ctx, req)
+				if err != nil {
+					upstream.SetError(schedulerStatus(err))
+					return nil, err
+				}
+				upstream.SetAttr("lt.backend", rec.header.Get(backendHeader))
+			} else {
+				var err error
+				rec, err = p.buffer(r.WithContext(ctx))
+				if err != nil {
+					upstream.SetError(err.Error())
+					return nil, err
+				}
+			}
+			upstream.SetAttr("http.status_code", rec.status)
+			if rec.status >= 500 {
+				upstream.SetError(http.StatusText(rec.status))
+			}
+			return rec, nil
+		})
+		lookup.SetAttr("lt.coalesced", shared)
+		lookup.SetAttr("lt.attempt", attempt)
+		if err != nil {
+			lookup.SetError(err.Error())
+		}
+		lookup.End()
+
+		// A deadline, seek or cancellation only concerns the request that
+		// started the shared call; the others try again on their own
+		if err != nil && shared && attempt == 0 && r.Context().Err() == nil && !errors.Is(err, errQueueFull) {
+			continue
+		}
+
+		if err != nil {
+			p.writeSchedulerError(w, err)
+			return
+		}
+
+		if key != nil && resp.status < 300 {
+			p.keys.Charge(key, req.Chars())
+		}
+		if shared {
+			w.Header().Set("X-Coalesced", "true")
+		}
+		resp.Replay(w)
+		return
+	}
+}
+
+// buffer sends r upstream and records the whole response. Shared calls run
+// outside the handler of any client, where the panic ReverseProxy raises
+// when it cannot copy a body would crash the process, so it is turned into
+// an error: the cancellation of r, or errResponseCutOff.
+func (p *libreTranslateProxy) buffer(r *http.Request) (rec *bufferedResponse, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			rec, err = nil, errResponseCutOff
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				err = ctxErr
+			}
+		}
+	}()
+
+	rec = newBufferedResponse()
+	p.proxy.ServeHTTP(rec, r)
+	return rec, nil
+}
+
+// serveKeyed checks the client's API key on a translating route other than
+// /translate, replacing it with the upstream key, and meters the request
+// once it has been answered successfully
+func (p *libreTranslateProxy) serveKeyed(w http.ResponseWriter, r *http.Request) {
+	limit := int64(maxTranslateBody)
+	if r.URL.Path == "/translate_file" {
+		limit = maxFileBody
+	}
+	call, err := parseAPICall(r, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer call.Close()
+
+	source, target := call.Get("source"), call.Get("target")
+	if info := infoFrom(r); info != nil && source != "" && target != "" {
+		info.pair = p.metrics.pairLabel(source, target)
+	}
+	chars := call.Chars()
+	key, err := p.authorize(r, call.Get("api_key"), source, target, chars)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	call.Set("api_key", p.keysCfg.UpstreamAPIKey)
+	if err := call.setBody(r); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.Header.Del("Authorization")
+
+	rec := &statusRecorder{ResponseWriter: w}
+	p.forward(rec, r, p.clientID(r, key), ticketFromHeaders(r))
+	if key != nil && rec.Status() < 300 {
+		p.keys.Charge(key, chars)
+	}
+}
+
+// serveLanguages answers with the languages of every shard merged
+func (p *libreTranslateProxy) serveLanguages(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	languages, err := p.pool.Languages(r.Context())
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errNoUpstream) {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSONError(w, status, fmt.Sprintf("Could not list the languages of the shards: %v", err))
+		return
+	}
+	body, err := json.Marshal(languages)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if p.cassette != nil {
+		p.cassette.Capture(r, http.StatusOK, w.Header(), body, time.Since(start))
+	}
+	w.Write(body)
+}
+
+// acquire waits for an upstream slot, tracing the time spent in the queue
+func (p *libreTranslateProxy) acquire(ctx context.Context, ticket *sharedTicket) (func(), error) {
+	_, wait := p.tracer.Start(ctx, "queue wait", spanKindInternal)
+	defer wait.End()
+
+	release, err := p.sched.AcquireShared(ctx, ticket)
+	// Requests sharing the call may have raised its priority meanwhile
+	wait.SetAttr("lt.priority", priorityLabel(ticket.Ticket().Priority))
+	if err != nil {
+		wait.SetError(schedulerStatus(err))
+	}
+	return release, err
+}
+
+// serveSeek drops the queued cues a playback session has seeked past. The
+// body is JSON: {"session": "...", "position": seconds}.
+func (p *libreTranslateProxy) serveSeek(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var seek struct {
+		Session  string  `json:"session"`
+		Position float64 `json:"position"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&seek); err != nil || seek.Session == "" {
+		writeJSONError(w, http.StatusBadRequest, "Expected JSON with session and position")
+		return
+	}
+
+	dropped := p.sched.Seek(seek.Session, seek.Position)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"dropped": dropped})
+}
+
+// authorize checks the API key sent in the body or as a bearer token
+func (p *libreTranslateProxy) authorize(r *http.Request, secret, source, target string, chars int) (*APIKey, error) {
+	if header := r.Header.Get("Authorization"); secret == "" && strings.HasPrefix(header, "Bearer ") {
+		secret = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if secret == "" {
+		if p.keysCfg.Required {
+			return nil, &keyError{status: http.StatusForbidden, message: "Please provide an API key"}
+		}
+		return nil, nil
+	}
+
+	return p.keys.Authorize(secret, source, target, chars)
+}
+
+// writeKeyError answers a request whose API key was refused
+func writeKeyError(w http.ResponseWriter, err error) {
+	var kerr *keyError
+	if !errors.As(err, &kerr) {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if kerr.retryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(kerr.retryAfter))
+	}
+	writeJSONError(w, kerr.status, kerr.message)
+}
+
+// clientID names the client of r for the rate limit: its key when the limit
+// is by key, and its address otherwise
+func (p *libreTranslateProxy) clientID(r *http.Request, key *APIKey) string {
+	if key != nil && p.limits.RateBy == "key" {
+		return "key:" + key.ID
+	}
+	return "ip:" + clientIP(r)
+}
+
+// allowed reports whether path passes the allow and deny lists
+func (p *libreTranslateProxy) allowed(path string) bool {
+	for _, prefix := range p.cfg.Deny {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+
+	if len(p.cfg.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range p.cfg.Allow {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeoutFor returns the total timeout of requests for path
+func (p *libreTranslateProxy) timeoutFor(path string) time.Duration {
+	return routeTimeout(path, p.cfg.Timeout, p.cfg.RouteTimeouts)
+}
+
+// routeTimeout returns the timeout of the longest prefix of path in routes,
+// or def when none matches
+func routeTimeout(path string, def Duration, routes map[string]Duration) time.Duration {
+	timeout := time.Duration(def)
+	longest := -1
+	for prefix, t := range routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			timeout = time.Duration(t)
+			longest = len(prefix)
+		}
+	}
+	return timeout
+}
+
+// clientIP returns the address of the client that sent r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retryAfterSeconds formats d as a Retry-After value, rounding up
+func retryAfterSeconds(d time.Duration) string {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestProxy serves a proxy to the server at target, with the defaults
+// changed by configure
+func newTestProxy(t *testing.T, target string, configure func(*Config)) (*libreTranslateProxy, *httptest.Server) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Backend.Type = "external"
+	cfg.Keys.File = filepath.Join(t.TempDir(), "keys.json")
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	p, err := newLibreTranslateProxy(target, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return p, srv
+}
+
+func TestProxyTranslate(t *testing.T) {
+	b := startFake(t, FakeConfig{})
+	_, srv := newTestProxy(t, b.URL(), nil)
+
+	status, answer := translateText(t, srv.URL, "Hello", "es")
+	if status != http.StatusOK || answer["translatedText"] != "[es] Hello" {
+		t.Fatalf("proxied translation answered %d %v", status, answer)
+	}
+
+	resp, err := http.Get(srv.URL + "/languages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxied languages answered %d", resp.StatusCode)
+	}
+}
+
+func TestProxyServerDown(t *testing.T) {
+	b := startFake(t, FakeConfig{})
+	b.Stop()
+	_, srv := newTestProxy(t, b.URL(), func(cfg *Config) { cfg.Proxy.Retry.Attempts = 0 })
+
+	status, answer := translateText(t, srv.URL, "Hello", "es")
+	if status != http.StatusBadGateway || answer["kind"] != "connect" {
+		t.Fatalf("translation without a server answered %d %v", status, answer)
+	}
+}
+
+func TestProxyUpstreamStallsMidBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/translate" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"translatedText": "[es] Hel`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(upstream.Close)
+
+	for _, chain := range [][]ChainLinkConfig{nil, {{Type: "local"}}} {
+		_, srv := newTestProxy(t, upstream.URL, func(cfg *Config) {
+			cfg.Proxy.Timeout = Duration(200 * time.Millisecond)
+			cfg.Proxy.RouteTimeouts = nil
+			cfg.Proxy.Retry.Attempts = 0
+			cfg.Fallback.Chain = chain
+		})
+
+		// The shared call must fail without taking the process down
+		status, answer := translateText(t, srv.URL, "Hello", "es")
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("translation cut off by the timeout answered %d %v", status, answer)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// resourceLimits are the limits applied to a running server. They are kept
+// in the instance state so that status, the dashboard and metrics can
+// compare usage against them.
+type resourceLimits struct {
+	MemoryBytes uint64  `json:"memory_bytes,omitempty"`
+	CPUs        float64 `json:"cpus,omitempty"`
+	Nice        int     `json:"nice,omitempty"`
+	Threads     int     `json:"threads,omitempty"`
+	WarnPercent int     `json:"warn_percent,omitempty"`
+	// Method is how the limits are enforced: cgroup, priority or none
+	Method string `json:"method,omitempty"`
+	// Cgroup is the cgroup v2 directory created for the server
+	Cgroup string `json:"cgroup,omitempty"`
+	// cgroupFD is the open cgroup directory the server is started into,
+	// until it has started
+	cgroupFD *os.File
+}
+
+// resourceUsage is a sample of what the server process group uses
+type resourceUsage struct {
+	RSSBytes   uint64   `json:"rss_bytes"`
+	CPUSeconds float64  `json:"cpu_seconds"`
+	CPUPercent float64  `json:"cpu_percent"`
+	Threads    int      `json:"threads"`
+	Processes  int      `json:"processes"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+// threadEnvVars are read by the math libraries under CTranslate2 and
+// PyTorch to size their thread pools
+var threadEnvVars = []string{"OMP_NUM_THREADS", "MKL_NUM_THREADS", "OPENBLAS_NUM_THREADS"}
+
+// configured reports whether cfg asks for any limit
+func (cfg ResourceConfig) configured() bool {
+	return cfg.MemoryMB > 0 || cfg.CPUs > 0 || cfg.Nice != 0 || cfg.Threads > 0
+}
+
+// prepareResourceLimits sets up cmd before it starts: thread counts go
+// through the environment, on Windows the priority is a creation flag, and
+// on Linux the server starts inside a cgroup of its own. It returns the
+// limits to finish with applyResourceLimits, or nil when nothing was asked
+// for.
+func prepareResourceLimits(cmd *exec.Cmd, cfg ResourceConfig) *resourceLimits {
+	if cfg.Threads > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		for _, name := range threadEnvVars {
+			cmd.Env = append(cmd.Env, name+"="+strconv.Itoa(cfg.Threads))
+		}
+	}
+	setStartPriority(cmd, cfg.Nice)
+	if !cfg.configured() {
+		return nil
+	}
+
+	limits := &resourceLimits{
+		MemoryBytes: uint64(cfg.MemoryMB) << 20,
+		CPUs:        cfg.CPUs,
+		Nice:        cfg.Nice,
+		Threads:     cfg.Threads,
+		WarnPercent: cfg.WarnPercent,
+		Method:      "none",
+	}
+	if limits.MemoryBytes > 0 || limits.CPUs > 0 {
+		if err := startInCgroup(cmd, limits); err != nil {
+			slog.Warn("Could not apply memory and CPU limits", "error", err)
+			limits.MemoryBytes, limits.CPUs = 0, 0
+		}
+	}
+	return limits
+}
+
+// applyResourceLimits finishes limiting the process group led by pid once
+// it has started, returning limits
+func applyResourceLimits(pid int, limits *resourceLimits) *resourceLimits {
+	if limits == nil {
+		return nil
+	}
+	limits.closeCgroupFD()
+	if err := limitProcess(pid, limits); err != nil {
+		slog.Warn("Could not apply resource limits", "pid", pid, "error", err)
+	}
+
+	slog.Info("Applied resource limits", "method", limits.Method, "memory", formatBytes(limits.MemoryBytes),
+		"cpus", limits.CPUs, "nice", limits.Nice, "threads", limits.Threads)
+	return limits
+}
+
+// closeCgroupFD closes the cgroup directory once the server has started in
+// it, or failed to
+func (l *resourceLimits) closeCgroupFD() {
+	if l.cgroupFD != nil {
+		l.cgroupFD.Close()
+		l.cgroupFD = nil
+	}
+}
+
+// releaseResourceLimits removes the cgroup of a server that has exited or
+// failed to start
+func releaseResourceLimits(limits *resourceLimits) {
+	if limits == nil {
+		return
+	}
+	limits.closeCgroupFD()
+	if limits.Cgroup == "" {
+		return
+	}
+	// The kernel needs a moment to notice the group is empty
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(limits.Cgroup); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	slog.Debug("Could not remove cgroup", "cgroup", limits.Cgroup)
+}
+
+// nearLimits reports which limits usage has come close to
+func (l *resourceLimits) nearLimits(u *resourceUsage) (memory, cpu bool) {
+	if l == nil {
+		return false, false
+	}
+	threshold := float64(l.WarnPercent) / 100
+	if threshold <= 0 {
+		threshold = 0.9
+	}
+	memory = l.MemoryBytes > 0 && float64(u.RSSBytes) >= threshold*float64(l.MemoryBytes)
+	cpu = l.CPUs > 0 && u.CPUPercent >= threshold*l.CPUs*100
+	return memory, cpu
+}
+
+// warnings describes the limits that usage is close to
+func (l *resourceLimits) warnings(u *resourceUsage) []string {
+	memory, cpu := l.nearLimits(u)
+	var out []string
+	if memory {
+		out = append(out, fmt.Sprintf("memory at %.0f%% of the %s limit",
+			float64(u.RSSBytes)/float64(l.MemoryBytes)*100, formatBytes(l.MemoryBytes)))
+	}
+	if cpu {
+		out = append(out, fmt.Sprintf("CPU at %.0f%% of the %g core limit", u.CPUPercent, l.CPUs))
+	}
+	return out
+}
+
+// usageSampler turns successive process statistics into CPU percentages.
+// The first sample of a process has no CPU percentage.
+type usageSampler struct {
+	mu   sync.Mutex
+	pid  int
+	last procStats
+	at   time.Time
+}
+
+// Sample measures the process group led by pid
+func (s *usageSampler) Sample(pid int, limits *resourceLimits) (*resourceUsage, error) {
+	stats, err := processStats(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	usage := &resourceUsage{RSSBytes: stats.RSSBytes, CPUSeconds: stats.CPUSeconds, Threads: stats.Threads, Processes: stats.Processes}
+	if s.pid == pid && !s.at.IsZero() {
+		if elapsed := now.Sub(s.at).Seconds(); elapsed > 0 {
+			usage.CPUPercent = (stats.CPUSeconds - s.last.CPUSeconds) / elapsed * 100
+		}
+	}
+	s.pid, s.last, s.at = pid, stats, now
+
+	usage.Warnings = limits.warnings(usage)
+	return usage, nil
+}
+
+// monitorResources logs a warning whenever the server gets close to one of
+// its limits, and again once it has dropped back
+func monitorResources(pid int, limits *resourceLimits) {
+	if limits == nil || (limits.MemoryBytes == 0 && limits.CPUs == 0) {
+		return
+	}
+
+	sampler := &usageSampler{}
+	warned := false
+	for range time.Tick(15 * time.Second) {
+		usage, err := sampler.Sample(pid, limits)
+		if err != nil {
+			return
+		}
+		switch {
+		case len(usage.Warnings) > 0 && !warned:
+			slog.Warn("Server is close to its resource limits", "warnings", usage.Warnings,
+				"rss", formatBytes(usage.RSSBytes), "cpu_percent", int(usage.CPUPercent))
+			warned = true
+		case len(usage.Warnings) == 0 && warned:
+			slog.Info("Server resource usage is back below its limits")
+			warned = false
+		}
+	}
+}
+
+// formatBytes prints a byte count with a binary unit
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupSeq numbers the cgroups of the servers started by this process, as
+// the pool runs several at once
+var cgroupSeq atomic.Int64
+
+// limitProcess sets the nice level of the process group led by pid; memory
+// and CPU limits come from the cgroup it was started in
+func limitProcess(pid int, limits *resourceLimits) error {
+	if limits.Nice == 0 {
+		return nil
+	}
+	if err := setGroupNice(pid, limits.Nice); err != nil {
+		return fmt.Errorf("failed to set nice level: %w", err)
+	}
+	if limits.Method == "none" {
+		limits.Method = "priority"
+	}
+	return nil
+}
+
+// startInCgroup creates a cgroup v2 group with memory.max and cpu.max set
+// and has cmd start inside it, so the server never runs unlimited, not even
+// while it loads its models
+func startInCgroup(cmd *exec.Cmd, limits *resourceLimits) error {
+	dir, err := createCgroup(limits)
+	if err != nil {
+		return fmt.Errorf("memory and CPU limits need a writable cgroup v2: %w", err)
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(fd.Fd())
+	limits.Method, limits.Cgroup, limits.cgroupFD = "cgroup", dir, fd
+	return nil
+}
+
+// createCgroup creates a cgroup for one server next to the one this process
+// runs in, since only leaf cgroups may hold processes. Each server gets its
+// own, removed by releaseResourceLimits when it exits.
+func createCgroup(limits *resourceLimits) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("no cgroup v2 hierarchy at %s", cgroupRoot)
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	own := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		// cgroup v2 has a single hierarchy, listed as "0::/path"
+		if strings.HasPrefix(line, "0::") {
+			own = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if own == "" {
+		return "", fmt.Errorf("cgroup v2 is not in use")
+	}
+
+	parent := filepath.Join(cgroupRoot, filepath.Dir(own))
+	subtree, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return "", err
+	}
+	enabled := strings.Fields(string(subtree))
+	if limits.MemoryBytes > 0 && !slices.Contains(enabled, "memory") {
+		return "", fmt.Errorf("memory controller not enabled in %s", parent)
+	}
+	if limits.CPUs > 0 && !slices.Contains(enabled, "cpu") {
+		return "", fmt.Errorf("cpu controller not enabled in %s", parent)
+	}
+
+	dir := filepath.Join(parent, fmt.Sprintf("libretranslate-server-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+
+	if limits.MemoryBytes > 0 {
+		err = os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatUint(limits.MemoryBytes, 10)), 0644)
+	}
+	if err == nil && limits.CPUs > 0 {
+		const period = 100000
+		err = os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(fmt.Sprintf("%d %d", int(limits.CPUs*period), period)), 0644)
+	}
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
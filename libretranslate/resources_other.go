@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// limitProcess lowers the priority of the process group led by pid
+func limitProcess(pid int, limits *resourceLimits) error {
+	if limits.Nice == 0 {
+		return nil
+	}
+	if err := setGroupNice(pid, limits.Nice); err != nil {
+		return fmt.Errorf("failed to set nice level: %w", err)
+	}
+	limits.Method = "priority"
+	return nil
+}
+
+// startInCgroup fails: memory and CPU caps need Linux
+func startInCgroup(cmd *exec.Cmd, limits *resourceLimits) error {
+	return fmt.Errorf("memory and CPU limits are only supported on Linux; use the container backend instead")
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setStartPriority does nothing on Unix, where the priority is set once the
+// process group exists
+func setStartPriority(cmd *exec.Cmd, nice int) {}
+
+// setGroupNice sets the nice level of every process in the group led by pid
+func setGroupNice(pid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PGRP, pid, nice)
+}
@@ -0,0 +1,44 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// Windows priority classes used in place of nice levels
+const (
+	belowNormalPriorityClass = 0x00004000
+	idlePriorityClass        = 0x00000040
+)
+
+// setStartPriority starts cmd in a lower priority class when a nice level
+// is configured: below normal, or idle from nice 15
+func setStartPriority(cmd *exec.Cmd, nice int) {
+	if nice <= 0 {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if nice >= 15 {
+		cmd.SysProcAttr.CreationFlags |= idlePriorityClass
+	} else {
+		cmd.SysProcAttr.CreationFlags |= belowNormalPriorityClass
+	}
+}
+
+// limitProcess records the priority class set at start
+func limitProcess(pid int, limits *resourceLimits) error {
+	if limits.Nice > 0 {
+		limits.Method = "priority"
+	}
+	return nil
+}
+
+// startInCgroup fails: memory and CPU caps are not supported on Windows
+func startInCgroup(cmd *exec.Cmd, limits *resourceLimits) error {
+	return fmt.Errorf("memory and CPU limits are not supported on Windows; use the container backend instead")
+}
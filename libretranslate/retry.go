@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errHeaderTimeout is returned when LibreTranslate accepted a request but
+// did not start answering within the header timeout
+var errHeaderTimeout = errors.New("timed out waiting for response headers")
+
+// upstreamTimeouts bound the phases of one upstream attempt; zero means no
+// bound other than the total timeout of the route
+type upstreamTimeouts struct {
+	Connect time.Duration
+	Header  time.Duration
+}
+
+// timeoutsKey is the context key of the upstream timeouts of a request
+type timeoutsKey struct{}
+
+// withTimeouts attaches the upstream timeouts of a request to ctx
+func withTimeouts(ctx context.Context, t upstreamTimeouts) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, t)
+}
+
+// timeoutsFrom returns the upstream timeouts attached to ctx
+func timeoutsFrom(ctx context.Context) upstreamTimeouts {
+	t, _ := ctx.Value(timeoutsKey{}).(upstreamTimeouts)
+	return t
+}
+
+// dialUpstream connects to LibreTranslate within the connect timeout of the
+// request
+func dialUpstream(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if t := timeoutsFrom(ctx).Connect; t > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// retryable reports whether req may be sent again after a failure: GET and
+// HEAD requests, and POST requests to the configured routes whose body can
+// be replayed
+func (cfg RetryConfig) retryable(req *http.Request) bool {
+	if cfg.Attempts <= 0 {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return false
+		}
+		for _, route := range cfg.Routes {
+			if underRoute(req.URL.Path, route) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// underRoute reports whether path is route or below it, so that
+// "/translate" does not cover "/translate_file"
+func underRoute(path, route string) bool {
+	return path == route || strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/")
+}
+
+// backoff returns the delay before retry number attempt, counted from 0:
+// a random duration between half and all of the exponential backoff, so
+// that requests failing together do not come back together
+func (cfg RetryConfig) backoff(attempt int) time.Duration {
+	limit := time.Duration(cfg.Backoff) << attempt
+	if limit <= 0 || (cfg.MaxBackoff > 0 && limit > time.Duration(cfg.MaxBackoff)) {
+		limit = time.Duration(cfg.MaxBackoff)
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return limit/2 + time.Duration(rand.Int63n(int64(limit/2)+1))
+}
+
+// worthRetrying reports whether a failed attempt may go better on another
+// try: the server could not be reached, or answered 502, 503 or 504. A
+// server that took the request and timed out is likely still working on it,
+// so sending it the same request again only adds to its load.
+func worthRetrying(resp *http.Response, err error) bool {
+	if err != nil {
+		return isDialError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isDialError reports whether err means the server could not be reached
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// upstreamFailed reports whether the outcome of an attempt means the server
+// is in trouble, which counts against its circuit and is worth a retry. A
+// request cancelled by its client is not a failure, and neither is a 500,
+// which LibreTranslate sends when it cannot translate a particular text.
+func upstreamFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
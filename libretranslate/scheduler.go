@@ -0,0 +1,545 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errQueueFull is returned when no more requests may wait for the upstream
+	errQueueFull = errors.New("too many requests waiting for the translation server")
+	// errDeadlinePassed is returned for requests whose deadline expired while
+	// they were waiting
+	errDeadlinePassed = errors.New("deadline passed before the request could be sent")
+	// errSeekedPast is returned for queued cues the player has seeked past
+	errSeekedPast = errors.New("dropped because playback seeked past this cue")
+)
+
+// Request priorities, from least to most urgent
+const (
+	priorityPrefetch = 0
+	priorityNormal   = 1
+	priorityOnScreen = 2
+)
+
+// scheduleTicket describes how urgent a request is
+type scheduleTicket struct {
+	Priority int
+	// Deadline is when the result stops being useful; zero means never
+	Deadline time.Time
+	// Session and CueTime identify a subtitle cue within a playback session,
+	// in seconds of media time, so queued work can follow seeks
+	Session string
+	CueTime float64
+	HasCue  bool
+}
+
+// queueItem is a request waiting for an upstream slot
+type queueItem struct {
+	ticket scheduleTicket
+	seq    int64
+	index  int
+	ready  chan struct{}
+	err    error
+	// raised wakes the waiter when the ticket was raised
+	raised chan struct{}
+}
+
+// sharedTicket is the ticket of an upstream call whose result several
+// requests share. Each request joining the call raises it to its own
+// priority and deadline, also while the call waits in the queue.
+type sharedTicket struct {
+	mu     sync.Mutex
+	ticket scheduleTicket
+	// sched and item are set while the call waits in the queue
+	sched *upstreamScheduler
+	item  *queueItem
+}
+
+// newSharedTicket creates the ticket of a call started for ticket
+func newSharedTicket(ticket scheduleTicket) *sharedTicket {
+	return &sharedTicket{ticket: ticket}
+}
+
+// Ticket returns the current ticket of the call
+func (t *sharedTicket) Ticket() scheduleTicket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ticket
+}
+
+// Join raises the ticket to the priority and deadline of other, when they
+// are more urgent, and moves the call up the queue
+func (t *sharedTicket) Join(other scheduleTicket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	raised := false
+	if other.Priority > t.ticket.Priority {
+		t.ticket.Priority = other.Priority
+		raised = true
+	}
+	if !other.Deadline.IsZero() && (t.ticket.Deadline.IsZero() || other.Deadline.Before(t.ticket.Deadline)) {
+		t.ticket.Deadline = other.Deadline
+		raised = true
+	}
+	if raised && t.item != nil {
+		t.sched.raise(t.item, t.ticket)
+	}
+}
+
+// itemHeap orders waiting requests, most urgent first
+type itemHeap []*queueItem
+
+func (h itemHeap) Len() int { return len(h) }
+
+func (h itemHeap) Less(i, j int) bool {
+	a, b := h[i].ticket, h[j].ticket
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	// Within a session, the cue closest to the playhead comes first
+	if a.HasCue && b.HasCue && a.Session == b.Session && a.CueTime != b.CueTime {
+		return a.CueTime < b.CueTime
+	}
+	if !a.Deadline.Equal(b.Deadline) {
+		if a.Deadline.IsZero() || b.Deadline.IsZero() {
+			return b.Deadline.IsZero()
+		}
+		return a.Deadline.Before(b.Deadline)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *itemHeap) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+	return item
+}
+
+// upstreamScheduler limits how many requests LibreTranslate handles at once.
+// Waiting requests are served by priority, then by cue position and deadline;
+// requests whose deadline passes are dropped.
+type upstreamScheduler struct {
+	mu       sync.Mutex
+	max      int
+	maxQueue int
+	active   int
+	waiting  itemHeap
+	seq      int64
+
+	served     int64
+	rejected   int64
+	expired    int64
+	seeked     int64
+	totalWait  time.Duration
+	maxWait    time.Duration
+	avgService time.Duration
+}
+
+// schedulerStats is a snapshot of the scheduler exposed through the status API
+type schedulerStats struct {
+	Active         int         `json:"active"`
+	Waiting        int         `json:"waiting"`
+	WaitingBy      map[int]int `json:"waiting_by_priority"`
+	MaxConcurrent  int         `json:"max_concurrent"`
+	MaxQueue       int         `json:"max_queue"`
+	Served         int64       `json:"served"`
+	Rejected       int64       `json:"rejected"`
+	Expired        int64       `json:"expired"`
+	SeekDropped    int64       `json:"seek_dropped"`
+	AvgWaitMs      float64     `json:"avg_wait_ms"`
+	MaxWaitMs      float64     `json:"max_wait_ms"`
+	AvgUpstreamMs  float64     `json:"avg_upstream_ms"`
+	RetryAfterSecs int         `json:"retry_after_secs"`
+}
+
+// newUpstreamScheduler creates a scheduler allowing max concurrent requests
+// and maxQueue waiting ones. A max of zero disables the limit.
+func newUpstreamScheduler(max, maxQueue int) *upstreamScheduler {
+	return &upstreamScheduler{max: max, maxQueue: maxQueue}
+}
+
+// SetMax changes the number of concurrent requests, letting waiting ones
+// through when it grows
+func (s *upstreamScheduler) SetMax(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.max = max
+	s.wakeNext()
+}
+
+// Acquire waits for a free upstream slot. The returned function must be
+// called once the upstream request has finished.
+func (s *upstreamScheduler) Acquire(ctx context.Context, ticket scheduleTicket) (func(), error) {
+	return s.AcquireShared(ctx, newSharedTicket(ticket))
+}
+
+// AcquireShared waits for a free upstream slot for a call whose ticket may
+// be raised while it waits
+func (s *upstreamScheduler) AcquireShared(ctx context.Context, shared *sharedTicket) (func(), error) {
+	start := time.Now()
+
+	// Holding shared.mu until the item is queued keeps a Join from
+	// slipping in between
+	shared.mu.Lock()
+	ticket := shared.ticket
+	if !ticket.Deadline.IsZero() && !start.Before(ticket.Deadline) {
+		shared.mu.Unlock()
+		s.mu.Lock()
+		s.expired++
+		s.mu.Unlock()
+		return nil, errDeadlinePassed
+	}
+
+	s.mu.Lock()
+	if s.max <= 0 || (s.active < s.max && s.waiting.Len() == 0) {
+		s.active++
+		s.mu.Unlock()
+		shared.mu.Unlock()
+		return s.releaser(start), nil
+	}
+
+	if s.waiting.Len() >= s.maxQueue {
+		s.rejected++
+		s.mu.Unlock()
+		shared.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	s.seq++
+	item := &queueItem{ticket: ticket, seq: s.seq, ready: make(chan struct{}), raised: make(chan struct{}, 1)}
+	heap.Push(&s.waiting, item)
+	s.mu.Unlock()
+	shared.sched, shared.item = s, item
+	shared.mu.Unlock()
+
+	defer func() {
+		shared.mu.Lock()
+		shared.item = nil
+		shared.mu.Unlock()
+	}()
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		var expire <-chan time.Time
+		if !ticket.Deadline.IsZero() {
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(time.Until(ticket.Deadline))
+			expire = timer.C
+		}
+
+		select {
+		case <-item.ready:
+			if item.err != nil {
+				return nil, item.err
+			}
+			s.recordWait(time.Since(start))
+			return s.releaser(time.Now()), nil
+		case <-item.raised:
+			s.mu.Lock()
+			ticket = item.ticket
+			s.mu.Unlock()
+		case <-expire:
+			return nil, s.abandon(item, errDeadlinePassed)
+		case <-ctx.Done():
+			return nil, s.abandon(item, ctx.Err())
+		}
+	}
+}
+
+// raise gives a waiting request a more urgent ticket
+func (s *upstreamScheduler) raise(item *queueItem, ticket scheduleTicket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item.index < 0 {
+		// Already handed a slot or dropped
+		return
+	}
+	item.ticket = ticket
+	heap.Fix(&s.waiting, item.index)
+	select {
+	case item.raised <- struct{}{}:
+	default:
+	}
+}
+
+// abandon removes item from the queue after its caller gave up
+func (s *upstreamScheduler) abandon(item *queueItem, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-item.ready:
+		if item.err != nil {
+			return item.err
+		}
+		// The slot was handed over while we gave up; pass it on
+		s.active--
+		s.wakeNext()
+	default:
+		heap.Remove(&s.waiting, item.index)
+	}
+
+	if err == errDeadlinePassed {
+		s.expired++
+	}
+	return err
+}
+
+// Seek drops the queued cues of session that lie before position, as they
+// will never be shown, and returns how many were dropped
+func (s *upstreamScheduler) Seek(session string, position float64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.waiting[:0]
+	dropped := 0
+	for _, item := range s.waiting {
+		t := item.ticket
+		if t.HasCue && t.Session == session && t.CueTime < position {
+			item.index = -1
+			item.err = errSeekedPast
+			close(item.ready)
+			dropped++
+			continue
+		}
+		kept = append(kept, item)
+	}
+	for i := len(kept); i < len(s.waiting); i++ {
+		s.waiting[i] = nil
+	}
+
+	s.waiting = kept
+	for i, item := range s.waiting {
+		item.index = i
+	}
+	heap.Init(&s.waiting)
+
+	s.seeked += int64(dropped)
+	return dropped
+}
+
+// releaser returns the function freeing the slot taken at start
+func (s *upstreamScheduler) releaser(start time.Time) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.recordServiceLocked(time.Since(start))
+			s.active--
+			s.wakeNext()
+		})
+	}
+}
+
+// wakeNext hands free slots to the most urgent waiting requests, dropping
+// those whose deadline has passed; s.mu must be held
+func (s *upstreamScheduler) wakeNext() {
+	now := time.Now()
+	for s.waiting.Len() > 0 && s.active < s.max {
+		item := heap.Pop(&s.waiting).(*queueItem)
+		if d := item.ticket.Deadline; !d.IsZero() && !now.Before(d) {
+			item.err = errDeadlinePassed
+			s.expired++
+			close(item.ready)
+			continue
+		}
+		s.active++
+		close(item.ready)
+	}
+}
+
+// recordWait accounts for the time a request spent in the queue
+func (s *upstreamScheduler) recordWait(wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totalWait += wait
+	if wait > s.maxWait {
+		s.maxWait = wait
+	}
+}
+
+// recordServiceLocked keeps a moving average of upstream request durations
+func (s *upstreamScheduler) recordServiceLocked(d time.Duration) {
+	s.served++
+	if s.avgService == 0 {
+		s.avgService = d
+	} else {
+		s.avgService = (s.avgService*9 + d) / 10
+	}
+}
+
+// RetryAfter estimates when a rejected request may find room in the queue
+func (s *upstreamScheduler) RetryAfter() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retryAfterLocked()
+}
+
+// retryAfterLocked is RetryAfter with s.mu held
+func (s *upstreamScheduler) retryAfterLocked() time.Duration {
+	if s.max <= 0 || s.avgService == 0 {
+		return time.Second
+	}
+	rounds := float64(s.waiting.Len()+1) / float64(s.max)
+	estimate := time.Duration(math.Ceil(rounds)) * s.avgService
+	if estimate < time.Second {
+		return time.Second
+	}
+	return estimate
+}
+
+// Stats returns the current queue depth and wait times
+func (s *upstreamScheduler) Stats() schedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := schedulerStats{
+		Active:         s.active,
+		Waiting:        s.waiting.Len(),
+		WaitingBy:      make(map[int]int),
+		MaxConcurrent:  s.max,
+		MaxQueue:       s.maxQueue,
+		Served:         s.served,
+		Rejected:       s.rejected,
+		Expired:        s.expired,
+		SeekDropped:    s.seeked,
+		MaxWaitMs:      float64(s.maxWait) / float64(time.Millisecond),
+		AvgUpstreamMs:  float64(s.avgService) / float64(time.Millisecond),
+		RetryAfterSecs: int(s.retryAfterLocked().Seconds()),
+	}
+	for _, item := range s.waiting {
+		stats.WaitingBy[item.ticket.Priority]++
+	}
+	if s.served > 0 {
+		stats.AvgWaitMs = float64(s.totalWait) / float64(s.served) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+type ticketKey struct{}
+
+// withTicket has the local link of the fallback chain wait for a slot of
+// the scheduler with ticket
+func withTicket(ctx context.Context, ticket *sharedTicket) context.Context {
+	return context.WithValue(ctx, ticketKey{}, ticket)
+}
+
+// ticketFrom returns the ticket attached to ctx, or nil
+func ticketFrom(ctx context.Context) *sharedTicket {
+	ticket, _ := ctx.Value(ticketKey{}).(*sharedTicket)
+	return ticket
+}
+
+// ticketFromHeaders reads the scheduling hints a client sent as headers:
+// X-Priority, X-Deadline, X-Session and X-Cue-Time
+func ticketFromHeaders(r *http.Request) scheduleTicket {
+	ticket := scheduleTicket{Priority: priorityNormal}
+	applyTicketFields(&ticket,
+		r.Header.Get("X-Priority"),
+		r.Header.Get("X-Deadline"),
+		r.Header.Get("X-Session"),
+		r.Header.Get("X-Cue-Time"))
+	return ticket
+}
+
+// applyTicketFields sets the non-empty hints on ticket. A priority is
+// "onscreen", "normal", "prefetch" or a number; a deadline is an RFC 3339
+// time or Unix milliseconds; a cue time is in seconds.
+func applyTicketFields(ticket *scheduleTicket, priority, deadline, session, cueTime string) {
+	switch strings.ToLower(priority) {
+	case "":
+	case "onscreen", "high", "now":
+		ticket.Priority = priorityOnScreen
+	case "normal":
+		ticket.Priority = priorityNormal
+	case "prefetch", "low":
+		ticket.Priority = priorityPrefetch
+	default:
+		// Numbers outside the named levels would jump ahead of every
+		// on-screen cue, or behind every prefetch
+		if n, err := strconv.Atoi(priority); err == nil {
+			ticket.Priority = min(max(n, priorityPrefetch), priorityOnScreen)
+		}
+	}
+
+	if deadline != "" {
+		if t, err := time.Parse(time.RFC3339Nano, deadline); err == nil {
+			ticket.Deadline = t
+		} else if ms, err := strconv.ParseInt(deadline, 10, 64); err == nil {
+			ticket.Deadline = time.UnixMilli(ms)
+		}
+	}
+
+	if session != "" {
+		ticket.Session = session
+	}
+	if cueTime != "" {
+		if t, err := strconv.ParseFloat(cueTime, 64); err == nil {
+			ticket.CueTime = t
+			ticket.HasCue = true
+		}
+	}
+}
+
+// schedulerError maps a scheduling failure to an HTTP status and message
+func schedulerError(err error) (int, string) {
+	switch {
+	case errors.Is(err, errQueueFull):
+		return http.StatusTooManyRequests, err.Error()
+	case errors.Is(err, errDeadlinePassed):
+		return http.StatusGatewayTimeout, err.Error()
+	case errors.Is(err, errSeekedPast):
+		return http.StatusGone, err.Error()
+	default:
+		return http.StatusServiceUnavailable, "Gave up waiting for the translation server"
+	}
+}
+
+// schedulerStatus names a scheduling failure for the X-Scheduler-Status header
+func schedulerStatus(err error) string {
+	switch {
+	case errors.Is(err, errQueueFull):
+		return "queue-full"
+	case errors.Is(err, errDeadlinePassed):
+		return "deadline-passed"
+	case errors.Is(err, errSeekedPast):
+		return "seeked-past"
+	default:
+		return "cancelled"
+	}
+}
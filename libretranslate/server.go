@@ -2,226 +2,349 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"os"
-	"os/exec"
-	"os/signal"
-	"path/filepath"
-	"strconv"
-	"syscall"
+	"log/slog"
+	"sort"
 	"time"
-
-	"github.com/fatih/color"
 )
 
-var pidFile = filepath.Join(os.TempDir(), "libretranslate.pid")
-
-// startServer starts the LibreTranslate server
+// startServer starts LibreTranslate using the configured backend, on a free
+// port when port is 0
 func startServer(host string, port int, verbose bool) error {
-	// Check if already running
-	if isServerRunning(port) {
-		color.Yellow("⚠️  Server already running on port %d\n", port)
-		return nil
+	if port == 0 {
+		free, err := freePort(host)
+		if err != nil {
+			return err
+		}
+		port = free
+		slog.Info("Picked a free port", "port", port)
 	}
 
-	color.Green("✅ Starting LibreTranslate server on %s:%d\n", host, port)
-
-	// Build command
-	args := []string{
-		"--host", host,
-		"--port", strconv.Itoa(port),
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: host, Port: port, Verbose: verbose})
+	if err != nil {
+		return err
 	}
 
-	if verbose {
-		args = append(args, "--debug")
+	// Something answering on the port is only our server if the instance
+	// state says so; anything else is a conflict. An external server always
+	// answers, and starting it begins monitoring it.
+	if b.Name() != "external" {
+		state, err := loadInstanceState()
+		if err != nil {
+			state = &instanceState{}
+		}
+		ours := state.servesPort(port)
+		if ours && b.Health() == nil {
+			slog.Warn("Server already running", "url", b.URL())
+			return nil
+		}
+		if err := checkPortFree(host, port); err != nil {
+			if ours {
+				return fmt.Errorf("the server on port %d is still starting", port)
+			}
+			return err
+		}
 	}
 
-	cmd := exec.Command(getLibreTranslateCommand(), args...)
+	slog.Info("Starting LibreTranslate server", "host", host, "port", port, "backend", b.Name())
 
-	// Set up output pipes
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	serverProgress.Begin(b.Name())
+	if err := b.Start(); err != nil {
+		serverProgress.Finish(err)
+		return err
 	}
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	state := recordStart(b, port)
+
+	// The server runs in its own process group and no longer sees Ctrl+C,
+	// so stop it from here. Once stopping is closed the process exits from
+	// the shutdown hooks, after the rest of the process group is gone. The
+	// web interface starts servers repeatedly, so the hook is removed again.
+	stopping := make(chan struct{})
+	defer onShutdown(func() {
+		close(stopping)
+		slog.Info("Shutting down server")
+		b.Stop()
+	})()
+	awaitShutdown := func() {
+		select {
+		case <-stopping:
+			select {}
+		default:
+		}
 	}
 
-	// Start the server
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
+	// Wait for server to be ready
+	slog.Info("Waiting for server to be ready; loading models may take 5-10 minutes on first startup")
+	if err := waitForServer(b, 10*time.Minute); err != nil {
+		awaitShutdown()
+		serverProgress.Finish(err)
+		// Reap the server as it exits, so that stopping it ends right away
+		exited := make(chan struct{})
+		go func() {
+			b.Wait()
+			close(exited)
+		}()
+		b.Stop()
+		<-exited
+		return fmt.Errorf("server failed to start: %w", err)
 	}
 
-	// Save PID
-	if err := savePID(cmd.Process.Pid); err != nil {
-		color.Yellow("⚠️  Warning: could not save PID: %v\n", err)
+	// The server answers, but loads each model on its first translation
+	if appConfig.Warmup.Enabled {
+		result, err := warmUp(b.URL(), appConfig.Warmup, serverProgress)
+		if err != nil {
+			slog.Warn("Skipped warm-up", "error", err)
+		} else if err := appendWarmupHistory(result); err != nil {
+			slog.Warn("Could not save warm-up history", "error", err)
+		}
+		state.Warmup = result
 	}
+	serverProgress.Finish(nil)
 
-	// Handle output
-	go streamOutput(stdout, "INFO")
-	go streamOutput(stderr, "ERROR")
-
-	// Wait for server to be ready
-	color.Cyan("⏳ Waiting for server to be ready (this may take 5-10 minutes on first startup)...\n")
-	color.Yellow("   LibreTranslate needs to load AI models, please be patient...\n\n")
-	if err := waitForServer(port, 10*time.Minute); err != nil {
-		cmd.Process.Kill()
-		return fmt.Errorf("server failed to start: %w", err)
+	state.ReadyAt = time.Now()
+	if state.PID != 0 {
+		// Record the identity again in case the command exec'd another program
+		if identity, err := processIdentity(state.PID); err == nil {
+			state.Identity = identity
+		}
+	}
+	if err := state.save(); err != nil {
+		slog.Warn("Could not save instance state", "error", err)
 	}
 
-	color.Green("✅ Server is ready!\n")
-	color.Cyan("📡 LibreTranslate API: http://%s:%d\n", host, port)
-	color.Cyan("🌐 Web Interface: http://%s:%d/frontend/v1.2.1/index.html\n", host, port)
-	color.Yellow("\n💡 Press Ctrl+C to stop the server\n\n")
-
-	// Set up signal handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	if state.PID != 0 {
+		go monitorResources(state.PID, state.Limits)
+	}
 
-	// Wait for signal or process to exit
-	go func() {
-		<-sigChan
-		color.Yellow("\n🛑 Shutting down server...\n")
-		cmd.Process.Signal(os.Interrupt)
-		time.Sleep(2 * time.Second)
-		cmd.Process.Kill()
-		removePID()
-		os.Exit(0)
-	}()
+	slog.Info("Server is ready", "api", b.URL(), "web", b.URL()+"/frontend/v1.2.1/index.html", "load_time", state.LoadTime().Round(time.Millisecond))
+	slog.Info("Press Ctrl+C to stop the server")
 
 	// Wait for process to complete
-	if err := cmd.Wait(); err != nil {
-		removePID()
+	err = b.Wait()
+	awaitShutdown()
+	if err != nil {
 		return fmt.Errorf("server exited with error: %w", err)
 	}
 
-	removePID()
 	return nil
 }
 
+// recordStart updates the instance state after b has been started on port
+func recordStart(b Backend, port int) *instanceState {
+	state, err := loadInstanceState()
+	if err != nil {
+		state = &instanceState{}
+	}
+
+	state.Starts++
+	state.Port = port
+	state.Backend = b.Name()
+	state.StartedAt = time.Now()
+	state.ReadyAt = time.Time{}
+	state.PID = 0
+	state.Identity = procIdentity{}
+	state.Limits = nil
+	state.Suspended = false
+	state.Warmup = nil
+	if p, ok := b.(interface{ PID() int }); ok {
+		// Only backends running the server as our own child have a PID
+		state.PID = p.PID()
+		state.Identity, _ = processIdentity(state.PID)
+	}
+	if l, ok := b.(interface{ ResourceLimits() *resourceLimits }); ok {
+		state.Limits = l.ResourceLimits()
+	}
+
+	if err := state.save(); err != nil {
+		slog.Warn("Could not save instance state", "error", err)
+	}
+	return state
+}
+
 // stopServer stops a running LibreTranslate server
 func stopServer(port int) error {
-	pid, err := readPID()
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: port})
 	if err != nil {
-		return fmt.Errorf("no server running (PID file not found)")
+		return err
 	}
+	return b.Stop()
+}
 
-	process, err := os.FindProcess(pid)
+// checkStatus checks if the server is running
+func checkStatus(port int) {
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: port})
 	if err != nil {
-		removePID()
-		return fmt.Errorf("server process not found")
+		slog.Error("Could not check the server", "error", err)
+		return
 	}
 
-	// Send interrupt signal
-	if err := process.Signal(os.Interrupt); err != nil {
-		// Try SIGTERM
-		if err := process.Signal(syscall.SIGTERM); err != nil {
-			// Force kill
-			process.Kill()
+	// The server may have been started with another backend, e.g. by fake-server
+	name := b.Name()
+	if state, err := loadInstanceState(); err == nil && state.servesPort(port) {
+		if state.Suspended {
+			slog.Info("Server is suspended while idle; the next translation resumes it", "url", b.URL())
+			return
+		}
+		if state.Backend != "" {
+			name = state.Backend
 		}
 	}
 
-	// Wait a bit and verify
-	time.Sleep(2 * time.Second)
+	if b.Health() == nil {
+		slog.Info("Server is running", "backend", name, "api", b.URL(), "web", b.URL()+"/frontend/v1.2.1/index.html")
+		printResourceUsage(port)
+		printWarmup(port)
+	} else {
+		slog.Warn("Server is not running", "url", b.URL())
+	}
+}
+
+// printResourceUsage logs what the server on port uses, when this tool
+// started it as a process it can inspect
+func printResourceUsage(port int) {
+	state, err := loadInstanceState()
+	if err != nil || state.PID == 0 || !state.servesPort(port) {
+		return
+	}
 
-	if isServerRunning(port) {
-		return fmt.Errorf("server still running, try manual kill: kill %d", pid)
+	// CPU usage is measured over a short interval
+	sampler := &usageSampler{}
+	if _, err := sampler.Sample(state.PID, state.Limits); err != nil {
+		return
+	}
+	time.Sleep(500 * time.Millisecond)
+	usage, err := sampler.Sample(state.PID, state.Limits)
+	if err != nil {
+		return
 	}
 
-	removePID()
-	return nil
+	memory := formatBytes(usage.RSSBytes)
+	cpu := fmt.Sprintf("%.0f%%", usage.CPUPercent)
+	if l := state.Limits; l != nil {
+		if l.MemoryBytes > 0 {
+			memory += " of " + formatBytes(l.MemoryBytes)
+		}
+		if l.CPUs > 0 {
+			cpu += fmt.Sprintf(" of %g cores", l.CPUs)
+		}
+	}
+	slog.Info("Server resources", "memory", memory, "cpu", cpu, "threads", usage.Threads, "processes", usage.Processes)
+	if l := state.Limits; l != nil {
+		slog.Info("Server resource limits", "method", l.Method, "nice", l.Nice, "threads", l.Threads)
+	}
+	if len(usage.Warnings) > 0 {
+		slog.Warn("Server is close to its resource limits", "warnings", usage.Warnings)
+	}
 }
 
-// checkStatus checks if the server is running
-func checkStatus(port int) {
-	if isServerRunning(port) {
-		color.Green("✅ Server is running on port %d\n", port)
+// printWarmup logs the warm-up in progress, or the latency of each pair
+// measured by the last one next to the previous LibreTranslate version
+func printWarmup(port int) {
+	state, err := loadInstanceState()
+	if err != nil || !state.servesPort(port) {
+		return
+	}
 
-		// Try to get version info
-		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/languages", port))
-		if err == nil {
-			defer resp.Body.Close()
-			color.Cyan("📡 API endpoint: http://127.0.0.1:%d\n", port)
-			color.Cyan("🌐 Web interface: http://127.0.0.1:%d/frontend/v1.2.1/index.html\n", port)
+	if state.ReadyAt.IsZero() {
+		if progress, err := readProgress(); err == nil && progress.Phase == phaseWarming {
+			slog.Info("Warming up models; not ready yet", "progress", progress.Detail)
 		}
-	} else {
-		color.Red("❌ Server is not running on port %d\n", port)
+		return
+	}
+
+	result := state.Warmup
+	if result == nil {
+		return
+	}
+	slog.Info("Warm-up", "pairs", len(result.Pairs), "took", secondsDuration(result.Duration), "version", result.Version)
+
+	previous := previousVersionWarmup(result)
+	pairs := result.Pairs
+	if len(pairs) > maxWarmupPairsShown {
+		// Show the slowest models to load
+		pairs = append([]pairLatency(nil), pairs...)
+		sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Cold > pairs[j].Cold })
+		pairs = pairs[:maxWarmupPairsShown]
+		slog.Info("Showing the slowest pairs to warm up", "shown", maxWarmupPairsShown)
+	}
+	for _, p := range pairs {
+		if p.Error != "" {
+			slog.Warn("Pair failed to warm up", "pair", p.languagePair.String(), "error", p.Error)
+			continue
+		}
+		attrs := []interface{}{"pair", p.languagePair.String(), "cold", roundLatency(p.Cold), "warm", roundLatency(p.Warm)}
+		if previous != nil {
+			if old := previous.pair(p.languagePair); old != nil && old.Error == "" {
+				attrs = append(attrs, "previous_version", previous.Version,
+					"previous_cold", roundLatency(old.Cold), "previous_warm", roundLatency(old.Warm))
+			}
+		}
+		slog.Info("Warm-up pair", attrs...)
+	}
+	if failed := result.Failed(); failed > 0 {
+		slog.Warn("Pairs failed to warm up", "failed", failed)
+	}
+}
+
+// maxWarmupPairsShown bounds the pairs listed by status
+const maxWarmupPairsShown = 15
+
+// roundLatency converts seconds to a duration rounded for display
+func roundLatency(secs float64) time.Duration {
+	d := time.Duration(secs * float64(time.Second))
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond)
 	}
+	return d.Round(time.Millisecond)
 }
 
 // isServerRunning checks if the server is responding
 func isServerRunning(port int) bool {
-	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/languages", port))
-	if err != nil {
+	return checkHealth(localURL(port)) == nil
+}
+
+// isServerReady checks whether the server answers and, when it was started
+// by this tool, has finished its warm-up
+func isServerReady(port int) bool {
+	if !isServerRunning(port) {
 		return false
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode == 200
+	state, err := loadInstanceState()
+	return err != nil || !state.Warming(port)
 }
 
 // waitForServer waits for the server to be ready
-func waitForServer(port int, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+func waitForServer(b Backend, timeout time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	lastReport := start
 
-	checkCount := 0
 	for time.Now().Before(deadline) {
-		if isServerRunning(port) {
-			fmt.Println() // New line after dots
+		if b.Health() == nil {
 			return nil
 		}
 
-		select {
-		case <-ticker.C:
-			// Print a dot every 5 seconds to show progress
-			checkCount++
-			if checkCount%12 == 0 {
-				// New line every minute
-				fmt.Println()
-			}
-			fmt.Print(".")
-		default:
-			time.Sleep(500 * time.Millisecond)
+		if time.Since(lastReport) >= 15*time.Second {
+			serverProgress.Report()
+			lastReport = time.Now()
 		}
+		time.Sleep(500 * time.Millisecond)
 	}
 
-	fmt.Println() // New line after dots
 	return fmt.Errorf("server did not start within %v", timeout)
 }
 
-// streamOutput streams command output to console
-func streamOutput(pipe io.ReadCloser, prefix string) {
+// streamOutput relays the lines of a child's output stream to the log at
+// the severity each line reports, and keeps them in logs
+func streamOutput(pipe io.ReadCloser, stream string, logs *logBuffer) {
+	parser := &childLogParser{}
 	scanner := bufio.NewScanner(pipe)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if prefix == "ERROR" {
-			color.Red("[%s] %s\n", prefix, line)
-		} else {
-			fmt.Printf("[%s] %s\n", prefix, line)
-		}
-	}
-}
-
-// savePID saves the process ID to a file
-func savePID(pid int) error {
-	return os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644)
-}
-
-// readPID reads the process ID from file
-func readPID() (int, error) {
-	data, err := os.ReadFile(pidFile)
-	if err != nil {
-		return 0, err
+		logs.Add(line)
+		serverProgress.Observe(line)
+		slog.Log(context.Background(), parser.Level(line), line, "source", "libretranslate", "stream", stream)
 	}
-	return strconv.Atoi(string(data))
-}
-
-// removePID removes the PID file
-func removePID() {
-	os.Remove(pidFile)
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errPairNotSharded is returned for translations between languages that no
+// shard loads together
+type errPairNotSharded struct {
+	pair   languagePair
+	shards []ShardConfig
+}
+
+func (e *errPairNotSharded) Error() string {
+	var held []string
+	for _, shard := range e.shards {
+		held = append(held, fmt.Sprintf("%s (%s)", shard.Name, strings.Join(shard.LoadOnly, ", ")))
+	}
+	return fmt.Sprintf("No shard holds both %s and %s; configured shards: %s", e.pair.Source, e.pair.Target, strings.Join(held, "; "))
+}
+
+// checkShards validates the shards of the configuration
+func checkShards(shards []ShardConfig) error {
+	seen := make(map[string]bool)
+	for _, shard := range shards {
+		if shard.Name == "" {
+			return fmt.Errorf("every shard needs a name")
+		}
+		if seen[shard.Name] {
+			return fmt.Errorf("shard %q is declared twice", shard.Name)
+		}
+		seen[shard.Name] = true
+		if len(shard.LoadOnly) < 2 {
+			return fmt.Errorf("shard %q must load at least two languages", shard.Name)
+		}
+		for _, code := range shard.LoadOnly {
+			if !languageCode.MatchString(code) {
+				return fmt.Errorf("shard %q: invalid language code %q", shard.Name, code)
+			}
+		}
+	}
+	return nil
+}
+
+// shardHolds reports whether languages contain both ends of pair. A source
+// of "auto" is detected among the languages of the shard.
+func shardHolds(languages []string, pair languagePair) bool {
+	return slices.Contains(languages, pair.Target) &&
+		(pair.Source == "auto" || slices.Contains(languages, pair.Source))
+}
+
+// holds reports whether m can translate pair; members that are not shards
+// load every language
+func (m *upstreamMember) holds(pair *languagePair) bool {
+	return pair == nil || m.kind != memberShard || shardHolds(m.languages, *pair)
+}
+
+// warmupPairs keeps the configured warm-up pairs m can translate
+func (m *upstreamMember) warmupPairs(configured []string) []string {
+	if m.kind != memberShard {
+		return configured
+	}
+	var pairs []string
+	for _, s := range configured {
+		source, target, _ := strings.Cut(s, ":")
+		if shardHolds(m.languages, languagePair{Source: source, Target: target}) {
+			pairs = append(pairs, s)
+		}
+	}
+	return pairs
+}
+
+// Sharded reports whether the pool routes translations by language pair
+func (p *upstreamPool) Sharded() bool {
+	return len(p.shards) > 0
+}
+
+// CheckPair returns an *errPairNotSharded when no shard is configured to
+// translate pair. Servers outside the shards, such as those listed in urls,
+// are assumed to hold every language.
+func (p *upstreamPool) CheckPair(pair languagePair) error {
+	if !p.Sharded() {
+		return nil
+	}
+	for _, shard := range p.shards {
+		if shardHolds(shard.LoadOnly, pair) {
+			return nil
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.members {
+		if m.kind != memberShard {
+			return nil
+		}
+	}
+	return &errPairNotSharded{pair: pair, shards: p.shards}
+}
+
+// languageInfo is an entry of the /languages list of LibreTranslate
+type languageInfo struct {
+	Code    string   `json:"code"`
+	Name    string   `json:"name"`
+	Targets []string `json:"targets"`
+}
+
+// Languages merges the language lists of the shards that are up. The
+// targets of a language are those that some shard loads along with it.
+func (p *upstreamPool) Languages(ctx context.Context) ([]languageInfo, error) {
+	p.mu.Lock()
+	var shards []*upstreamMember
+	for _, m := range p.members {
+		if m.kind == memberShard && !m.starting && !m.draining {
+			shards = append(shards, m)
+		}
+	}
+	p.mu.Unlock()
+	if len(shards) == 0 {
+		return nil, errNoUpstream
+	}
+
+	client := &http.Client{Transport: upstreamTransport, Timeout: 10 * time.Second}
+	lists := make([][]languageInfo, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, m := range shards {
+		wg.Add(1)
+		go func(i int, m *upstreamMember) {
+			defer wg.Done()
+			lists[i], errs[i] = fetchLanguages(ctx, client, strings.TrimSuffix(m.url.String(), "/"))
+		}(i, m)
+	}
+	wg.Wait()
+
+	merged := make(map[string]*languageInfo)
+	answered := 0
+	for i, list := range lists {
+		if errs[i] != nil {
+			continue
+		}
+		answered++
+		for _, language := range list {
+			entry, ok := merged[language.Code]
+			if !ok {
+				entry = &languageInfo{Code: language.Code, Name: language.Name}
+				merged[language.Code] = entry
+			}
+			for _, target := range language.Targets {
+				if !slices.Contains(entry.Targets, target) {
+					entry.Targets = append(entry.Targets, target)
+				}
+			}
+		}
+	}
+	if answered == 0 {
+		return nil, errs[0]
+	}
+
+	languages := make([]languageInfo, 0, len(merged))
+	for _, entry := range merged {
+		sort.Strings(entry.Targets)
+		languages = append(languages, *entry)
+	}
+	sort.Slice(languages, func(i, j int) bool { return languages[i].Code < languages[j].Code })
+	return languages, nil
+}
+
+// fetchLanguages reads the /languages list of the server at baseURL
+func fetchLanguages(ctx context.Context, client *http.Client, baseURL string) ([]languageInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/languages", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var languages []languageInfo
+	if err := json.NewDecoder(resp.Body).Decode(&languages); err != nil {
+		return nil, err
+	}
+	return languages, nil
+}
+
+// pairKey is the context key of the language pair of a translation
+type pairKey struct{}
+
+// withPair tells the pool which language pair a request translates
+func withPair(ctx context.Context, pair languagePair) context.Context {
+	return context.WithValue(ctx, pairKey{}, pair)
+}
+
+// pairFrom returns the language pair attached to ctx, or nil
+func pairFrom(ctx context.Context) *languagePair {
+	pair, ok := ctx.Value(pairKey{}).(languagePair)
+	if !ok {
+		return nil
+	}
+	return &pair
+}
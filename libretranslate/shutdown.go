@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// shutdownHooks run when the process is interrupted, so that the servers it
+// started in their own process groups, which no longer see Ctrl+C, are
+// stopped before it exits
+var shutdownHooks struct {
+	mu    sync.Mutex
+	once  sync.Once
+	next  int
+	hooks map[int]func()
+}
+
+// onShutdown runs fn when the process receives Ctrl+C or SIGTERM, alongside
+// the other hooks, and exits once they all return. The returned function
+// removes fn.
+func onShutdown(fn func()) (remove func()) {
+	shutdownHooks.once.Do(func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigChan
+			runShutdownHooks()
+			os.Exit(0)
+		}()
+	})
+
+	shutdownHooks.mu.Lock()
+	defer shutdownHooks.mu.Unlock()
+	if shutdownHooks.hooks == nil {
+		shutdownHooks.hooks = make(map[int]func())
+	}
+	id := shutdownHooks.next
+	shutdownHooks.next++
+	shutdownHooks.hooks[id] = fn
+
+	return func() {
+		shutdownHooks.mu.Lock()
+		defer shutdownHooks.mu.Unlock()
+		delete(shutdownHooks.hooks, id)
+	}
+}
+
+// runShutdownHooks runs the registered hooks concurrently and waits for them
+func runShutdownHooks() {
+	shutdownHooks.mu.Lock()
+	hooks := make([]func(), 0, len(shutdownHooks.hooks))
+	for _, fn := range shutdownHooks.hooks {
+		hooks = append(hooks, fn)
+	}
+	shutdownHooks.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, fn := range hooks {
+		wg.Add(1)
+		go func(fn func()) {
+			defer wg.Done()
+			fn()
+		}(fn)
+	}
+	wg.Wait()
+}
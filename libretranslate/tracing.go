@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds as defined by OpenTelemetry
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Span status codes as defined by OpenTelemetry
+const (
+	spanStatusUnset = 0
+	spanStatusError = 2
+)
+
+// tracer records spans and hands them to an exporter in batches. A nil
+// tracer is valid and records nothing, which is how tracing is disabled.
+type tracer struct {
+	service  string
+	exporter spanExporter
+	queue    chan *span
+}
+
+// spanExporter sends finished spans somewhere
+type spanExporter interface {
+	Export(service string, spans []*span) error
+}
+
+// span is one timed operation of a trace
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   []spanAttr
+	status  int
+	message string
+}
+
+// spanAttr is a key and a string, int, float64 or bool value
+type spanAttr struct {
+	Key   string
+	Value interface{}
+}
+
+// spanContextKey is the context key of the current *span
+type spanContextKey struct{}
+
+// newTracer creates the tracer configured by cfg, or nil when tracing is off
+func newTracer(cfg TracingConfig) (*tracer, error) {
+	var exporter spanExporter
+	switch cfg.Exporter {
+	case "":
+		return nil, nil
+	case "otlp":
+		exporter = &otlpExporter{
+			url:     strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+			headers: cfg.Headers,
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}
+	case "stdout":
+		exporter = &writerExporter{w: os.Stdout}
+	case "file":
+		if err := os.MkdirAll(filepath.Dir(cfg.File), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create trace directory: %w", err)
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter = &writerExporter{w: f}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (expected otlp, stdout or file)", cfg.Exporter)
+	}
+
+	t := &tracer{service: cfg.ServiceName, exporter: exporter, queue: make(chan *span, 4096)}
+	go t.run()
+	return t, nil
+}
+
+// run exports finished spans every few seconds or when a batch is full
+func (t *tracer) run() {
+	const batchSize = 256
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.service, batch); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Start begins a span that is a child of the span in ctx, if any
+func (t *tracer) Start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), sampled: true}
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// StartRequest begins the server span of r, continuing the trace of an
+// incoming traceparent header
+func (t *tracer) StartRequest(r *http.Request, name string) (context.Context, *span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+
+	ctx := r.Context()
+	if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, spanContextKey{}, remote)
+	}
+
+	ctx, s := t.Start(ctx, name, spanKindServer)
+	s.SetAttr("http.method", r.Method)
+	s.SetAttr("http.route", routeLabel(r.URL.Path))
+	s.SetAttr("client.address", clientIP(r))
+	return ctx, s
+}
+
+// spanFrom returns the current span of ctx
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent span
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	s.sampled = flags&1 == 1
+	return s, true
+}
+
+// Traceparent returns the W3C traceparent header naming s as the parent
+func (s *span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// SetAttr records an attribute on the span
+func (s *span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, spanAttr{Key: key, Value: value})
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = spanStatusError
+	s.message = message
+}
+
+// End finishes the span and queues it for export
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if !s.sampled {
+		return
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// Drop spans rather than slow requests down when the exporter lags
+	}
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (e *otlpExporter) Export(service string, spans []*span) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]spanAttr{{Key: "service.name", Value: service}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "libretranslate-server"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp encodes s in the OTLP JSON format
+func (s *span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.status != spanStatusUnset {
+		out["status"] = map[string]interface{}{"code": s.status, "message": s.message}
+	}
+	return out
+}
+
+// otlpAttributes encodes attributes as OTLP key/value pairs
+func otlpAttributes(attrs []spanAttr) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": a.Key, "value": value})
+	}
+	return out
+}
+
+// writerExporter writes one JSON object per span, for offline debugging
+type writerExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *writerExporter) Export(service string, spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		s.mu.Lock()
+		attrs := make(map[string]interface{}, len(s.attrs))
+		for _, a := range s.attrs {
+			attrs[a.Key] = a.Value
+		}
+		record := map[string]interface{}{
+			"service":     service,
+			"name":        s.name,
+			"trace_id":    hex.EncodeToString(s.traceID[:]),
+			"span_id":     hex.EncodeToString(s.spanID[:]),
+			"start":       s.start.Format(time.RFC3339Nano),
+			"duration_ms": float64(s.end.Sub(s.start)) / float64(time.Millisecond),
+			"attributes":  attrs,
+		}
+		if s.parentID != [8]byte{} {
+			record["parent_id"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.status == spanStatusError {
+			record["error"] = s.message
+		}
+		s.mu.Unlock()
+
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
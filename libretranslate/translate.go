@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxTranslateBody bounds the size of a /translate request body
+const maxTranslateBody = 1 << 20
+
+// maxFileBody bounds the size of a /translate_file request body
+const maxFileBody = 32 << 20
+
+// translateRequest is the body of a LibreTranslate /translate call
+type translateRequest struct {
+	Q            []string
+	Batch        bool
+	Source       string
+	Target       string
+	Format       string
+	Alternatives int
+	APIKey       string
+
+	// Scheduling hints, see applyTicketFields
+	Priority string
+	Deadline string
+	Session  string
+	CueTime  string
+
+	// RemoteAddr is the address of the client, forwarded to LibreTranslate
+	RemoteAddr string
+}
+
+// parseTranslateRequest reads a /translate request sent as JSON or as form
+// data, the two encodings LibreTranslate accepts
+func parseTranslateRequest(r *http.Request) (*translateRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxTranslateBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+	if len(body) > maxTranslateBody {
+		return nil, fmt.Errorf("request body too large")
+	}
+
+	req := &translateRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "application/json" {
+		var raw struct {
+			Q            json.RawMessage `json:"q"`
+			Source       string          `json:"source"`
+			Target       string          `json:"target"`
+			Format       string          `json:"format"`
+			Alternatives int             `json:"alternatives"`
+			APIKey       string          `json:"api_key"`
+			Priority     interface{}     `json:"priority"`
+			Deadline     interface{}     `json:"deadline"`
+			Session      string          `json:"session"`
+			CueTime      interface{}     `json:"cue_time"`
+		}
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+
+		var single string
+		if err := json.Unmarshal(raw.Q, &single); err == nil {
+			req.Q = []string{single}
+		} else if err := json.Unmarshal(raw.Q, &req.Q); err == nil {
+			req.Batch = true
+		} else {
+			return nil, fmt.Errorf("invalid request: missing q parameter")
+		}
+
+		req.Source = raw.Source
+		req.Target = raw.Target
+		req.Format = raw.Format
+		req.Alternatives = raw.Alternatives
+		req.APIKey = raw.APIKey
+		req.Priority = jsonFieldString(raw.Priority)
+		req.Deadline = jsonFieldString(raw.Deadline)
+		req.Session = raw.Session
+		req.CueTime = jsonFieldString(raw.CueTime)
+	} else {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := r.ParseMultipartForm(maxTranslateBody); err != nil && err != http.ErrNotMultipart {
+			return nil, fmt.Errorf("invalid form body: %w", err)
+		}
+
+		req.Q = []string{r.PostForm.Get("q")}
+		req.Source = r.PostForm.Get("source")
+		req.Target = r.PostForm.Get("target")
+		req.Format = r.PostForm.Get("format")
+		req.Alternatives, _ = strconv.Atoi(r.PostForm.Get("alternatives"))
+		req.APIKey = r.PostForm.Get("api_key")
+		req.Priority = r.PostForm.Get("priority")
+		req.Deadline = r.PostForm.Get("deadline")
+		req.Session = r.PostForm.Get("session")
+		req.CueTime = r.PostForm.Get("cue_time")
+	}
+
+	if req.Source == "" || req.Target == "" {
+		return nil, fmt.Errorf("invalid request: missing source or target parameter")
+	}
+
+	return req, nil
+}
+
+// jsonFieldString returns a JSON string or number field as text
+func jsonFieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// Chars returns the number of characters to translate
+func (t *translateRequest) Chars() int {
+	n := 0
+	for _, q := range t.Q {
+		n += utf8.RuneCountInString(q)
+	}
+	return n
+}
+
+// MarshalJSON encodes the request as LibreTranslate expects it
+func (t *translateRequest) MarshalJSON() ([]byte, error) {
+	body := map[string]interface{}{
+		"source": t.Source,
+		"target": t.Target,
+	}
+
+	if t.Batch {
+		body["q"] = t.Q
+	} else if len(t.Q) > 0 {
+		body["q"] = t.Q[0]
+	}
+	if t.Format != "" {
+		body["format"] = t.Format
+	}
+	if t.Alternatives > 0 {
+		body["alternatives"] = t.Alternatives
+	}
+	if t.APIKey != "" {
+		body["api_key"] = t.APIKey
+	}
+
+	return json.Marshal(body)
+}
+
+// setBody replaces the body of r with the JSON encoding of t
+func (t *translateRequest) setBody(r *http.Request) error {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	replaceBody(r, body, "application/json")
+	return nil
+}
+
+// replaceBody makes body, of the given content type, the body of r
+func replaceBody(r *http.Request, body []byte, contentType string) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	// Lets the upstream pool send the request again to another server
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Del("Content-Encoding")
+}
+
+// apiCall is the body of a LibreTranslate call other than /translate, such
+// as /detect or /translate_file, kept field by field so that its API key can
+// be replaced
+type apiCall struct {
+	// fields holds a JSON body; form holds the fields of a form instead
+	fields map[string]json.RawMessage
+	form   url.Values
+	// multipart holds the fields and files of a multipart form
+	multipart *multipart.Form
+}
+
+// parseAPICall reads a body of up to limit bytes sent as JSON, as a form or
+// as a multipart form
+func parseAPICall(r *http.Request, limit int64) (*apiCall, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, limit)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		call := &apiCall{}
+		if err := json.NewDecoder(r.Body).Decode(&call.fields); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if call.fields == nil {
+			call.fields = make(map[string]json.RawMessage)
+		}
+		return call, nil
+	}
+
+	if err := r.ParseMultipartForm(maxTranslateBody); err != nil && err != http.ErrNotMultipart {
+		return nil, fmt.Errorf("invalid form body: %w", err)
+	}
+	if r.MultipartForm != nil {
+		return &apiCall{multipart: r.MultipartForm}, nil
+	}
+	return &apiCall{form: r.PostForm}, nil
+}
+
+// Get returns the text of field name
+func (c *apiCall) Get(name string) string {
+	switch {
+	case c.fields != nil:
+		var v interface{}
+		json.Unmarshal(c.fields[name], &v)
+		return jsonFieldString(v)
+	case c.multipart != nil:
+		if values := c.multipart.Value[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	return c.form.Get(name)
+}
+
+// Set replaces field name with value, or removes it when value is empty
+func (c *apiCall) Set(name, value string) {
+	switch {
+	case c.fields != nil && value == "":
+		delete(c.fields, name)
+	case c.fields != nil:
+		c.fields[name], _ = json.Marshal(value)
+	case c.multipart != nil && value == "":
+		delete(c.multipart.Value, name)
+	case c.multipart != nil:
+		c.multipart.Value[name] = []string{value}
+	case value == "":
+		c.form.Del(name)
+	default:
+		c.form.Set(name, value)
+	}
+}
+
+// Chars returns the number of characters to handle: those of the text and
+// the suggestion, and the size of the uploaded files
+func (c *apiCall) Chars() int {
+	n := utf8.RuneCountInString(c.Get("q")) + utf8.RuneCountInString(c.Get("s"))
+	if c.multipart != nil {
+		for _, files := range c.multipart.File {
+			for _, file := range files {
+				n += int(file.Size)
+			}
+		}
+	}
+	return n
+}
+
+// setBody replaces the body of r with the fields of c, in the encoding they
+// were sent in
+func (c *apiCall) setBody(r *http.Request) error {
+	switch {
+	case c.fields != nil:
+		body, err := json.Marshal(c.fields)
+		if err != nil {
+			return err
+		}
+		replaceBody(r, body, "application/json")
+	case c.multipart != nil:
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, values := range c.multipart.Value {
+			for _, value := range values {
+				if err := mw.WriteField(name, value); err != nil {
+					return err
+				}
+			}
+		}
+		for _, files := range c.multipart.File {
+			for _, file := range files {
+				if err := copyFilePart(mw, file); err != nil {
+					return err
+				}
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+		replaceBody(r, body.Bytes(), mw.FormDataContentType())
+	default:
+		replaceBody(r, []byte(c.form.Encode()), "application/x-www-form-urlencoded")
+	}
+	return nil
+}
+
+// Close removes the files of a multipart form stored on disk
+func (c *apiCall) Close() {
+	if c.multipart != nil {
+		c.multipart.RemoveAll()
+	}
+}
+
+// copyFilePart writes an uploaded file to mw with the headers it came with
+func copyFilePart(mw *multipart.Writer, file *multipart.FileHeader) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := mw.CreatePart(file.Header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// writeJSONError answers with an error in the format LibreTranslate uses
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Translator is a translation engine the proxy can answer /translate with.
+// Every engine answers in the shape of LibreTranslate, so that the extension
+// calls the same API whichever one serves it.
+type Translator interface {
+	// Translate answers req the way LibreTranslate would. An error or an
+	// answer with a failure status lets the next engine of the chain try.
+	Translate(ctx context.Context, req *translateRequest) (*bufferedResponse, error)
+	// Languages lists the languages the engine translates between, or nil
+	// when it takes any pair
+	Languages(ctx context.Context) ([]languageInfo, error)
+}
+
+// localTranslator sends translations to the local servers through the
+// proxy, with its pool, timeouts, retries and circuit breaker
+type localTranslator struct {
+	proxy *libreTranslateProxy
+}
+
+// Translate waits for a slot of the scheduler when ctx carries a ticket, as
+// the local servers are the ones the scheduler protects
+func (t *localTranslator) Translate(ctx context.Context, req *translateRequest) (*bufferedResponse, error) {
+	if ticket := ticketFrom(ctx); ticket != nil {
+		release, err := t.proxy.acquire(ctx, ticket)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/translate", nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = req.RemoteAddr
+
+	out := *req
+	out.APIKey = t.proxy.keysCfg.UpstreamAPIKey
+	if err := out.setBody(r); err != nil {
+		return nil, err
+	}
+	return t.proxy.buffer(r)
+}
+
+func (t *localTranslator) Languages(ctx context.Context) ([]languageInfo, error) {
+	if t.proxy.pool.Sharded() {
+		return t.proxy.pool.Languages(ctx)
+	}
+	// The pool fills in the server
+	return fetchLanguages(ctx, &http.Client{Transport: t.proxy.transport()}, "http://upstream")
+}
+
+// libreTranslator sends translations to a LibreTranslate server other than
+// the local ones
+type libreTranslator struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func (t *libreTranslator) Translate(ctx context.Context, req *translateRequest) (*bufferedResponse, error) {
+	out := *req
+	out.APIKey = t.apiKey
+	body, err := json.Marshal(&out)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rec := newBufferedResponse()
+	rec.header.Set("Content-Type", resp.Header.Get("Content-Type"))
+	rec.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(rec, io.LimitReader(resp.Body, maxTranslateBody)); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (t *libreTranslator) Languages(ctx context.Context) ([]languageInfo, error) {
+	return fetchLanguages(ctx, t.client, t.baseURL)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the OpenAI-compatible translator
+const (
+	defaultBatchSize    = 16
+	defaultContextLines = 4
+	// sessionContextTTL is how long the lines of a session are remembered
+	sessionContextTTL = 30 * time.Minute
+)
+
+// languageNames spell out common language codes in prompts; models follow
+// "Japanese" more reliably than "ja"
+var languageNames = map[string]string{
+	"ar": "Arabic", "cs": "Czech", "da": "Danish", "de": "German", "el": "Greek",
+	"en": "English", "es": "Spanish", "fa": "Persian", "fi": "Finnish", "fr": "French",
+	"he": "Hebrew", "hi": "Hindi", "hu": "Hungarian", "id": "Indonesian", "it": "Italian",
+	"ja": "Japanese", "ko": "Korean", "nb": "Norwegian", "nl": "Dutch", "pl": "Polish",
+	"pt": "Portuguese", "ro": "Romanian", "ru": "Russian", "sv": "Swedish", "th": "Thai",
+	"tr": "Turkish", "uk": "Ukrainian", "vi": "Vietnamese",
+	"zh": "Simplified Chinese", "zt": "Traditional Chinese",
+}
+
+// openAITranslator translates subtitles with a language model served
+// through the OpenAI chat completions API, such as llama.cpp, Ollama or
+// vLLM. Batches are translated by one completion, and the latest lines of
+// each session are given to the model so that it follows the dialogue.
+type openAITranslator struct {
+	baseURL      string
+	apiKey       string
+	model        string
+	temperature  float64
+	batchSize    int
+	contextLines int
+	languages    []string
+	client       *http.Client
+
+	mu       sync.Mutex
+	sessions map[string]*subtitleContext
+}
+
+// subtitleContext is what was last translated in a session
+type subtitleContext struct {
+	pair   languagePair
+	lines  [][2]string
+	usedAt time.Time
+}
+
+// newOpenAITranslator creates a translator for the server at baseURL, e.g.
+// http://127.0.0.1:11434/v1 for Ollama
+func newOpenAITranslator(lc ChainLinkConfig, baseURL string, client *http.Client) (*openAITranslator, error) {
+	if lc.Model == "" {
+		return nil, fmt.Errorf("an openai backend needs a model")
+	}
+	t := &openAITranslator{
+		baseURL:      baseURL,
+		apiKey:       lc.APIKey,
+		model:        lc.Model,
+		temperature:  lc.Temperature,
+		batchSize:    lc.BatchSize,
+		contextLines: lc.ContextLines,
+		languages:    lc.Languages,
+		client:       client,
+		sessions:     make(map[string]*subtitleContext),
+	}
+	if t.batchSize <= 0 {
+		t.batchSize = defaultBatchSize
+	}
+	if t.contextLines == 0 {
+		t.contextLines = defaultContextLines
+	}
+	return t, nil
+}
+
+func (t *openAITranslator) Translate(ctx context.Context, req *translateRequest) (*bufferedResponse, error) {
+	pair := languagePair{Source: req.Source, Target: req.Target}
+	var texts []string
+	for start := 0; start < len(req.Q); start += t.batchSize {
+		batch := req.Q[start:min(start+t.batchSize, len(req.Q))]
+		translated, err := t.translateBatch(ctx, pair, req.Format, t.recent(req.Session, pair), batch)
+		if err != nil {
+			return nil, err
+		}
+		t.remember(req.Session, pair, batch, translated)
+		texts = append(texts, translated...)
+	}
+
+	rec := newBufferedResponse()
+	rec.header.Set("Content-Type", "application/json")
+	if req.Batch {
+		json.NewEncoder(rec).Encode(map[string]interface{}{"translatedText": texts})
+	} else {
+		json.NewEncoder(rec).Encode(map[string]interface{}{"translatedText": texts[0]})
+	}
+	return rec, nil
+}
+
+func (t *openAITranslator) Languages(ctx context.Context) ([]languageInfo, error) {
+	if len(t.languages) == 0 {
+		return nil, nil
+	}
+	var languages []languageInfo
+	for _, code := range t.languages {
+		languages = append(languages, languageInfo{Code: code, Name: languageName(code), Targets: t.languages})
+	}
+	return languages, nil
+}
+
+// translateBatch asks the model for one translation per line
+func (t *openAITranslator) translateBatch(ctx context.Context, pair languagePair, format string, earlier [][2]string, lines []string) ([]string, error) {
+	source := "the language it is written in"
+	if pair.Source != "auto" {
+		source = languageName(pair.Source)
+	}
+	system := fmt.Sprintf("You translate film and TV subtitles from %s to %s. "+
+		"Translate each line as natural spoken dialogue, about as short as the original so that it can be read on screen. "+
+		"Keep names, numbers and line breaks. Do not explain, censor or add notes. "+
+		"Answer with a JSON array of strings holding exactly one translation per input line, in the same order.",
+		source, languageName(pair.Target))
+	if format == "html" {
+		system += " The lines are HTML: keep every tag and translate only the text."
+	}
+
+	var user strings.Builder
+	if len(earlier) > 0 {
+		user.WriteString("Earlier lines and their translations, for context only:\n")
+		for _, line := range earlier {
+			fmt.Fprintf(&user, "%q → %q\n", line[0], line[1])
+		}
+		user.WriteString("\n")
+	}
+	encoded, _ := json.Marshal(lines)
+	user.WriteString("Translate these lines:\n")
+	user.Write(encoded)
+
+	content, err := t.complete(ctx, system, user.String())
+	if err != nil {
+		return nil, err
+	}
+	return parseTranslations(content, len(lines))
+}
+
+// complete sends a chat completion and returns the text of the answer
+func (t *openAITranslator) complete(ctx context.Context, system, user string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": t.model,
+		"messages": []map[string]string{
+			{"role": "system", "content": system},
+			{"role": "user", "content": user},
+		},
+		"temperature": t.temperature,
+		"stream":      false,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTranslateBody)).Decode(&answer); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("invalid completion: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if answer.Error.Message != "" {
+			return "", fmt.Errorf("completion failed with status %d: %s", resp.StatusCode, answer.Error.Message)
+		}
+		return "", fmt.Errorf("completion failed with status %d", resp.StatusCode)
+	}
+	if len(answer.Choices) == 0 {
+		return "", fmt.Errorf("completion has no choices")
+	}
+	return answer.Choices[0].Message.Content, nil
+}
+
+// parseTranslations reads the JSON array the model was asked for. Models
+// often wrap it in a code block or some text, and may answer a single line
+// with the bare translation.
+func parseTranslations(content string, n int) ([]string, error) {
+	content = strings.TrimSpace(content)
+	start, end := strings.Index(content, "["), strings.LastIndex(content, "]")
+	if start >= 0 && end > start {
+		var texts []string
+		if err := json.Unmarshal([]byte(content[start:end+1]), &texts); err == nil {
+			if len(texts) != n {
+				return nil, fmt.Errorf("model returned %d translations for %d lines", len(texts), n)
+			}
+			return texts, nil
+		}
+	}
+	if n == 1 && content != "" {
+		return []string{strings.Trim(content, "\"")}, nil
+	}
+	return nil, fmt.Errorf("model did not answer with a JSON array")
+}
+
+// recent returns the latest lines translated in session for pair
+func (t *openAITranslator) recent(session string, pair languagePair) [][2]string {
+	if session == "" || t.contextLines < 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.sessions[session]
+	if s == nil || s.pair != pair {
+		return nil
+	}
+	return append([][2]string(nil), s.lines...)
+}
+
+// remember keeps the latest lines of session as context for the next ones
+func (t *openAITranslator) remember(session string, pair languagePair, lines, translated []string) {
+	if session == "" || t.contextLines < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	s := t.sessions[session]
+	if s == nil || s.pair != pair {
+		for id, other := range t.sessions {
+			if now.Sub(other.usedAt) > sessionContextTTL {
+				delete(t.sessions, id)
+			}
+		}
+		s = &subtitleContext{pair: pair}
+		t.sessions[session] = s
+	}
+	for i := range lines {
+		s.lines = append(s.lines, [2]string{lines[i], translated[i]})
+	}
+	if len(s.lines) > t.contextLines {
+		s.lines = s.lines[len(s.lines)-t.contextLines:]
+	}
+	s.usedAt = now
+}
+
+// languageName returns the English name of a language code, or the code
+func languageName(code string) string {
+	if name, ok := languageNames[code]; ok {
+		return name
+	}
+	return code
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxWarmupHistory is the number of past warm-ups kept for comparison
+const maxWarmupHistory = 20
+
+// languagePair is a translation direction offered by the server
+type languagePair struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+func (p languagePair) String() string { return p.Source + "→" + p.Target }
+
+// pairLatency is how long one pair took before and after its model loaded
+type pairLatency struct {
+	languagePair
+	// Cold is the first translation, which loads the model
+	Cold float64 `json:"cold_secs"`
+	// Warm is a second translation with the model loaded
+	Warm  float64 `json:"warm_secs"`
+	Error string  `json:"error,omitempty"`
+}
+
+// warmupResult is the outcome of warming up a server after it started
+type warmupResult struct {
+	At time.Time `json:"at"`
+	// Version is the LibreTranslate version, "unknown" when not reported
+	Version  string        `json:"version"`
+	Manager  string        `json:"manager"`
+	Duration float64       `json:"duration_secs"`
+	Pairs    []pairLatency `json:"pairs"`
+}
+
+// Failed counts the pairs that could not be translated
+func (r *warmupResult) Failed() int {
+	n := 0
+	for _, p := range r.Pairs {
+		if p.Error != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// pair returns the latency recorded for p, or nil
+func (r *warmupResult) pair(p languagePair) *pairLatency {
+	for i := range r.Pairs {
+		if r.Pairs[i].languagePair == p {
+			return &r.Pairs[i]
+		}
+	}
+	return nil
+}
+
+// warmupHistoryPath returns the file keeping the results of past warm-ups
+func warmupHistoryPath() string {
+	if appConfig.Warmup.HistoryFile != "" {
+		return appConfig.Warmup.HistoryFile
+	}
+	return filepath.Join(configDir(), "warmup_history.json")
+}
+
+// warmUp sends a test translation twice for every pair, so that each model
+// is loaded before real requests need it, and records the latencies. The
+// pair being warmed up is reported to progress unless it is nil.
+func warmUp(baseURL string, cfg WarmupConfig, progress *startupProgress) (*warmupResult, error) {
+	pairs, err := warmupPairs(baseURL, cfg.Pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	result := &warmupResult{At: start, Version: serverVersion(baseURL), Manager: version}
+	slog.Info("Warming up language models", "pairs", len(pairs), "version", result.Version)
+
+	client := &http.Client{Timeout: time.Duration(cfg.Timeout)}
+	for i, pair := range pairs {
+		if progress != nil {
+			progress.Enter(phaseWarming, fmt.Sprintf("%s (%d/%d)", pair, i+1, len(pairs)))
+		}
+
+		latency := pairLatency{languagePair: pair}
+		latency.Cold, err = timeTranslation(client, baseURL, pair, cfg.Text)
+		if err == nil {
+			latency.Warm, err = timeTranslation(client, baseURL, pair, cfg.Text)
+		}
+		if err != nil {
+			latency.Error = err.Error()
+			slog.Warn("Warm-up translation failed", "pair", pair.String(), "error", err)
+		} else {
+			slog.Debug("Warmed up language pair", "pair", pair.String(),
+				"cold", roundLatency(latency.Cold), "warm", roundLatency(latency.Warm))
+		}
+		result.Pairs = append(result.Pairs, latency)
+	}
+	result.Duration = time.Since(start).Seconds()
+
+	slog.Info("Warm-up finished", "pairs", len(result.Pairs), "failed", result.Failed(), "duration", secondsDuration(result.Duration))
+	return result, nil
+}
+
+// warmupPairs returns the configured pairs, written "en:es", or every pair
+// the server offers
+func warmupPairs(baseURL string, configured []string) ([]languagePair, error) {
+	if len(configured) > 0 {
+		var pairs []languagePair
+		for _, s := range configured {
+			source, target, ok := strings.Cut(s, ":")
+			if !ok || source == "" || target == "" {
+				return nil, fmt.Errorf("invalid warm-up pair %q (expected source:target, e.g. en:es)", s)
+			}
+			pairs = append(pairs, languagePair{Source: source, Target: target})
+		}
+		return pairs, nil
+	}
+
+	resp, err := healthClient.Get(baseURL + "/languages")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list languages: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var languages []struct {
+		Code    string   `json:"code"`
+		Targets []string `json:"targets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&languages); err != nil {
+		return nil, fmt.Errorf("failed to list languages: %w", err)
+	}
+
+	var pairs []languagePair
+	for _, language := range languages {
+		for _, target := range language.Targets {
+			if target != language.Code {
+				pairs = append(pairs, languagePair{Source: language.Code, Target: target})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Source != pairs[j].Source {
+			return pairs[i].Source < pairs[j].Source
+		}
+		return pairs[i].Target < pairs[j].Target
+	})
+	return pairs, nil
+}
+
+// timeTranslation translates text once and returns how long it took
+func timeTranslation(client *http.Client, baseURL string, pair languagePair, text string) (float64, error) {
+	req := &translateRequest{Q: []string{text}, Source: pair.Source, Target: pair.Target, Format: "text", APIKey: appConfig.Keys.UpstreamAPIKey}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := client.Post(baseURL+"/translate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&answer)
+	elapsed := time.Since(start).Seconds()
+
+	if resp.StatusCode != http.StatusOK {
+		if answer.Error != "" {
+			return 0, fmt.Errorf("status %d: %s", resp.StatusCode, answer.Error)
+		}
+		return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return elapsed, nil
+}
+
+// serverVersion reads the LibreTranslate version from its API description
+func serverVersion(baseURL string) string {
+	resp, err := healthClient.Get(baseURL + "/spec")
+	if err != nil {
+		return "unknown"
+	}
+	defer resp.Body.Close()
+
+	var spec struct {
+		Info struct {
+			Version string `json:"version"`
+		} `json:"info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil || spec.Info.Version == "" {
+		return "unknown"
+	}
+	return spec.Info.Version
+}
+
+// loadWarmupHistory reads the results of past warm-ups, oldest first
+func loadWarmupHistory() []*warmupResult {
+	data, err := os.ReadFile(warmupHistoryPath())
+	if err != nil {
+		return nil
+	}
+	var history []*warmupResult
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil
+	}
+	return history
+}
+
+// appendWarmupHistory adds result to the warm-up history
+func appendWarmupHistory(result *warmupResult) error {
+	history := append(loadWarmupHistory(), result)
+	if len(history) > maxWarmupHistory {
+		history = history[len(history)-maxWarmupHistory:]
+	}
+
+	if err := os.MkdirAll(filepath.Dir(warmupHistoryPath()), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(warmupHistoryPath(), data, 0644)
+}
+
+// previousVersionWarmup returns the latest warm-up before result that ran
+// another LibreTranslate version, to show how an upgrade changed latency
+func previousVersionWarmup(result *warmupResult) *warmupResult {
+	history := loadWarmupHistory()
+	for i := len(history) - 1; i >= 0; i-- {
+		past := history[i]
+		if past.At.Before(result.At) && past.Version != result.Version {
+			return past
+		}
+	}
+	return nil
+}
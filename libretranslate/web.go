@@ -5,35 +5,91 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"strconv"
-
-	"github.com/fatih/color"
+	"time"
 )
 
-// libreTranslatePort is the port where LibreTranslate server runs
-var libreTranslatePort = 5000
+// webAuth guards the dashboard and management API
+var webAuth *managementAuth
+
+// webProxy forwards API requests to LibreTranslate
+var webProxy *libreTranslateProxy
+
+// statusSampler measures the server's CPU usage between status requests
+var statusSampler = &usageSampler{}
 
 // startWebInterface starts the web management interface
-func startWebInterface(port int) error {
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/api/status", handleStatus)
-	http.HandleFunc("/api/start", handleStartAPI)
-	http.HandleFunc("/api/stop", handleStopAPI)
-	http.HandleFunc("/translate", handleTranslateProxy)
-	http.HandleFunc("/languages", handleLanguagesProxy)
-
-	addr := fmt.Sprintf(":%d", port)
-	color.Green("✅ Web interface running at http://localhost:%d\n", port)
-	color.Yellow("💡 Press Ctrl+C to stop\n\n")
+func startWebInterface(bind string, port int) error {
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: serverPort()})
+	if err != nil {
+		return err
+	}
+
+	webProxy, err = newLibreTranslateProxy(b.URL(), appConfig)
+	if err != nil {
+		return err
+	}
+	go followServerPort(webProxy)
+
+	webAuth, err = newManagementAuth(appConfig.Web, bind)
+	if err != nil {
+		return err
+	}
+
+	http.HandleFunc("/api/status", webAuth.RequireAuth(handleStatus))
+	http.HandleFunc("/api/start", webAuth.RequireAuth(handleStartAPI))
+	http.HandleFunc("/api/stop", webAuth.RequireAuth(handleStopAPI))
+	http.HandleFunc("/api/progress", webAuth.RequireAuth(handleProgress))
+	http.HandleFunc("/api/chaos", webAuth.RequireAuth(handleChaosAPI))
+	webProxy.metrics.watchServer()
+	http.HandleFunc("/metrics", webAuth.RequireAuth(webProxy.metrics.registry.ServeHTTP))
+	// The LibreTranslate web UI lives at the upstream root
+	http.Handle("/ui/", http.StripPrefix("/ui", webProxy))
+	// Everything except the dashboard itself goes to LibreTranslate
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			webAuth.RequireHost(handleHome)(w, r)
+			return
+		}
+		webProxy.ServeHTTP(w, r)
+	})
+
+	addr := net.JoinHostPort(bind, strconv.Itoa(port))
+	slog.Info("Web interface running", "url", "http://"+addr)
+	if !isLoopbackHost(bind) {
+		slog.Warn("Listening beyond the loopback interface; remote dashboard access needs ?token=<token>", "token_file", appConfig.Web.TokenFile)
+	}
+	slog.Info("Press Ctrl+C to stop")
 
 	return http.ListenAndServe(addr, nil)
 }
 
+// followServerPort keeps the proxy pointed at the last started server,
+// whose port changes when it is started with --port auto
+func followServerPort(p *libreTranslateProxy) {
+	for range time.Tick(2 * time.Second) {
+		b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: serverPort()})
+		if err != nil {
+			continue
+		}
+		p.SetTarget(b.URL())
+	}
+}
+
 // handleHome serves the main web interface
 func handleHome(w http.ResponseWriter, r *http.Request) {
+	csrf, ok := webAuth.DashboardSession(w, r)
+	if !ok {
+		http.Error(w, "Unauthorized: open the dashboard with ?token=<management token>", http.StatusUnauthorized)
+		return
+	}
+
 	tmpl := template.Must(template.New("home").Parse(homeTemplate))
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, map[string]interface{}{"CSRFToken": csrf})
 }
 
 // handleStatus returns the server status as JSON
@@ -41,21 +97,72 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	portStr := r.URL.Query().Get("port")
-	port := 5000
+	port := serverPort()
 	if portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
 			port = p
 		}
 	}
 
+	b, err := newBackend(appConfig.Backend, StartOptions{Host: "127.0.0.1", Port: port})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A suspended server accepts connections but never answers
+	state, err := loadInstanceState()
+	suspended := err == nil && state.Suspended && state.servesPort(port)
+
 	status := map[string]interface{}{
-		"running": isServerRunning(port),
-		"port":    port,
+		"running":    !suspended && b.Health() == nil,
+		"suspended":  suspended,
+		"port":       port,
+		"backend":    b.Name(),
+		"url":        b.URL(),
+		"queue":      webProxy.sched.Stats(),
+		"coalescing": webProxy.flights.Stats(),
+		"pool":       webProxy.pool.Stats(),
+	}
+	if webProxy.idle != nil {
+		status["idle"] = webProxy.idle.Status()
+	}
+	if webProxy.chain != nil {
+		status["fallback"] = webProxy.chain.Stats()
+	}
+	if webProxy.cassette != nil {
+		status["cassette"] = webProxy.cassette.Stats()
+	}
+	if chaos := webProxy.chaos.Stats(); chaos.Enabled || len(chaos.Faults) > 0 {
+		status["chaos"] = chaos
+	}
+	if err == nil && state.servesPort(port) {
+		// Until the warm-up is done the server answers but is not ready
+		status["ready"] = !state.ReadyAt.IsZero()
+		status["warmup"] = state.Warmup
+	}
+	if err == nil && state.PID != 0 && state.servesPort(port) {
+		if usage, err := statusSampler.Sample(state.PID, state.Limits); err == nil {
+			status["resources"] = usage
+			status["limits"] = state.Limits
+		}
 	}
 
 	json.NewEncoder(w).Encode(status)
 }
 
+// handleProgress returns the progress of the current or last server start
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	progress, err := readProgress()
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"phase": "unknown"})
+		return
+	}
+	json.NewEncoder(w).Encode(progress)
+}
+
 // handleStartAPI handles starting the server via API
 func handleStartAPI(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -66,10 +173,26 @@ func handleStartAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	portStr := r.FormValue("port")
-	port := 5000
+	port := defaultServerPort
 	if portStr != "" {
-		if p, err := strconv.Atoi(portStr); err == nil {
-			port = p
+		p, err := parsePort(portStr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		port = p
+	}
+	if port == 0 {
+		p, err := freePort("127.0.0.1")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		port = p
+	} else if err := checkPortFree("127.0.0.1", port); err != nil {
+		if state, _ := loadInstanceState(); state == nil || !state.servesPort(port) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": err.Error(), "port": port})
+			return
 		}
 	}
 
@@ -97,7 +220,7 @@ func handleStopAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	portStr := r.FormValue("port")
-	port := 5000
+	port := serverPort()
 	if portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
 			port = p
@@ -118,85 +241,37 @@ func handleStopAPI(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// setCORSHeaders sets CORS headers required for browser extensions to access localhost
-func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		origin = "*"
-	}
-
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	// Required for Private Network Access (Chrome 94+)
-	w.Header().Set("Access-Control-Allow-Private-Network", "true")
-}
-
-// handleTranslateProxy proxies translation requests to LibreTranslate with CORS headers
-func handleTranslateProxy(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, r)
-
-	// Handle preflight OPTIONS request
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	// Proxy the request to LibreTranslate
-	targetURL := fmt.Sprintf("http://127.0.0.1:%d/translate", libreTranslatePort)
-
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
-	}
-
-	// Copy headers
-	proxyReq.Header.Set("Content-Type", r.Header.Get("Content-Type"))
-
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("LibreTranslate server not responding: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
-
-	// Copy response body
-	io.Copy(w, resp.Body)
-}
-
-// handleLanguagesProxy proxies language list requests to LibreTranslate with CORS headers
-func handleLanguagesProxy(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, r)
-
-	// Handle preflight OPTIONS request
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	// Proxy the request to LibreTranslate
-	targetURL := fmt.Sprintf("http://127.0.0.1:%d/languages", libreTranslatePort)
+// handleChaosAPI shows the chaos mode, or changes it: a JSON body replaces
+// its configuration, and the form value enabled=true or false toggles it
+func handleChaosAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-	resp, err := http.Get(targetURL)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("LibreTranslate server not responding: %v", err), http.StatusBadGateway)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		cfg := webProxy.chaos.Config()
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			cfg = ChaosConfig{}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&cfg); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid chaos configuration: %v", err))
+				return
+			}
+		} else if enabled, err := strconv.ParseBool(r.FormValue("enabled")); err == nil {
+			cfg.Enabled = enabled
+		} else {
+			writeJSONError(w, http.StatusBadRequest, "Expected a JSON configuration or enabled=true|false")
+			return
+		}
+		if err := webProxy.chaos.Set(cfg); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	io.Copy(w, resp.Body)
+	json.NewEncoder(w).Encode(webProxy.chaos.Stats())
 }
 
 // HTML template for web interface
@@ -206,6 +281,7 @@ const homeTemplate = `
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
     <title>LibreTranslate Server Manager</title>
     <style>
         * {
@@ -403,6 +479,25 @@ const homeTemplate = `
                 <span class="info-value" id="portValue">5000</span>
             </div>
 
+            <div class="info-row" id="progressRow" style="display: none;">
+                <span class="info-label">Startup</span>
+                <span class="info-value" id="progressValue"></span>
+            </div>
+
+            <div class="info-row" id="poolRow" style="display: none;">
+                <span class="info-label">Upstreams</span>
+                <span class="info-value" id="poolValue"></span>
+            </div>
+            <div class="info-row" id="idleRow" style="display: none;">
+                <span class="info-label">Idle Policy</span>
+                <span class="info-value" id="idleValue"></span>
+            </div>
+
+            <div class="info-row" id="resourcesRow" style="display: none;">
+                <span class="info-label">Resources</span>
+                <span class="info-value" id="resourcesValue"></span>
+            </div>
+
             <div class="info-row" id="apiLinkRow" style="display: none;">
                 <span class="info-label">API Endpoint</span>
                 <a href="" target="_blank" class="info-value" id="apiLink">Open</a>
@@ -418,23 +513,131 @@ const homeTemplate = `
         <div class="message" id="message"></div>
 
         <div class="links">
-            <a href="http://localhost:5000/frontend/v1.2.1/index.html" target="_blank" class="link">
+            <a href="/ui/" target="_blank" class="link">
                 📱 Open LibreTranslate Web Interface
             </a>
-            <a href="http://localhost:5000/docs" target="_blank" class="link">
+            <a href="/docs" target="_blank" class="link">
                 📚 API Documentation
             </a>
         </div>
     </div>
 
     <script>
+        // The port of the last started server, as reported by the status API
         let port = 5000;
+        const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
 
         function checkStatus() {
-            fetch('/api/status?port=' + port)
+            fetch('/api/status', {
+                headers: { 'X-CSRF-Token': csrfToken }
+            })
                 .then(res => res.json())
                 .then(data => {
+                    port = data.port;
+                    document.getElementById('portValue').textContent = port;
                     updateUI(data.running);
+                    if (data.suspended) {
+                        document.getElementById('statusText').textContent = 'Server Suspended (idle)';
+                    }
+                    updateIdle(data.idle);
+                    updatePool(data.pool);
+                    updateResources(data.resources, data.limits);
+                    checkProgress(data.running);
+                });
+        }
+
+        function formatBytes(n) {
+            const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+            let i = 0;
+            while (n >= 1024 && i < units.length - 1) {
+                n /= 1024;
+                i++;
+            }
+            return (i ? n.toFixed(1) : n) + ' ' + units[i];
+        }
+
+        function updatePool(pool) {
+            const row = document.getElementById('poolRow');
+            // A single server needs no pool summary unless its circuit is open
+            const alone = pool && pool.members.length < 2 && !pool.max_replicas && !pool.shards;
+            if (!pool || (alone && pool.members.every(m => m.circuit === 'closed'))) {
+                row.style.display = 'none';
+                return;
+            }
+
+            let text = pool.healthy + '/' + pool.members.length + ' healthy';
+            if (pool.shards) text += ' · ' + pool.shards + ' shards';
+            const starting = pool.members.filter(m => m.starting).map(m => m.name);
+            if (starting.length) text += ' · starting: ' + starting.join(', ');
+            if (pool.max_replicas) text += ' · ' + pool.replicas + ' replicas (' + pool.min_replicas + '-' + pool.max_replicas + ')';
+            const down = pool.members.filter(m => !m.healthy && !m.starting).map(m => m.name);
+            if (down.length) text += ' · ejected: ' + down.join(', ');
+            const open = pool.members.filter(m => m.circuit !== 'closed').map(m => m.name + ' (' + m.circuit.replace('_', ' ') + ')');
+            if (open.length) text += ' · circuit: ' + open.join(', ');
+            document.getElementById('poolValue').textContent = text;
+            row.style.display = 'flex';
+        }
+
+        function updateIdle(idle) {
+            const row = document.getElementById('idleRow');
+            if (!idle) {
+                row.style.display = 'none';
+                return;
+            }
+
+            let text = idle.state;
+            if (idle.after_secs) text += ' · ' + idle.action + 's after ' + formatSeconds(idle.after_secs) + ' idle';
+            if (idle.lazy_start) text += ' · starts on demand';
+            text += ' · last translation ' + formatSeconds(idle.idle_for_secs) + ' ago';
+            document.getElementById('idleValue').textContent = text;
+            row.style.display = 'flex';
+        }
+
+        function updateResources(usage, limits) {
+            const row = document.getElementById('resourcesRow');
+            const value = document.getElementById('resourcesValue');
+            if (!usage) {
+                row.style.display = 'none';
+                return;
+            }
+
+            let memory = formatBytes(usage.rss_bytes);
+            let cpu = Math.round(usage.cpu_percent) + '% CPU';
+            if (limits && limits.memory_bytes) memory += ' / ' + formatBytes(limits.memory_bytes);
+            if (limits && limits.cpus) cpu += ' / ' + limits.cpus + ' cores';
+            let text = memory + ' · ' + cpu + ' · ' + usage.threads + ' threads';
+            if (usage.warnings) text = '⚠️ ' + usage.warnings.join(', ') + ' · ' + text;
+            value.textContent = text;
+            value.style.color = usage.warnings ? '#b8860b' : '';
+            row.style.display = 'flex';
+        }
+
+        function formatSeconds(secs) {
+            secs = Math.round(secs);
+            return secs >= 60 ? Math.floor(secs / 60) + 'm ' + (secs % 60) + 's' : secs + 's';
+        }
+
+        function checkProgress(running) {
+            fetch('/api/progress', {
+                headers: { 'X-CSRF-Token': csrfToken }
+            })
+                .then(res => res.json())
+                .then(data => {
+                    const row = document.getElementById('progressRow');
+                    const starting = ['starting', 'downloading', 'loading', 'binding', 'warming'].includes(data.phase);
+                    if ((running && data.phase !== 'warming') || !starting) {
+                        row.style.display = data.phase === 'failed' ? 'flex' : 'none';
+                        document.getElementById('progressValue').textContent = 'Failed: ' + (data.error || '');
+                        return;
+                    }
+
+                    let text = data.phase;
+                    if (data.detail) text += ' ' + data.detail;
+                    text += ' · ' + formatSeconds(data.elapsed_secs);
+                    if (data.models_total) text += ' · ' + data.models_downloaded + '/' + data.models_total + ' models';
+                    if (data.eta_secs !== undefined) text += ' · about ' + formatSeconds(data.eta_secs) + ' left';
+                    document.getElementById('progressValue').textContent = text;
+                    row.style.display = 'flex';
                 });
         }
 
@@ -442,7 +645,10 @@ const homeTemplate = `
             showMessage('Starting server...', 'success');
             fetch('/api/start', {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+                headers: {
+                    'Content-Type': 'application/x-www-form-urlencoded',
+                    'X-CSRF-Token': csrfToken
+                },
                 body: 'port=' + port
             })
             .then(res => res.json())
@@ -456,7 +662,10 @@ const homeTemplate = `
             showMessage('Stopping server...', 'success');
             fetch('/api/stop', {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+                headers: {
+                    'Content-Type': 'application/x-www-form-urlencoded',
+                    'X-CSRF-Token': csrfToken
+                },
                 body: 'port=' + port
             })
             .then(res => res.json())